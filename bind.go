@@ -24,17 +24,24 @@ type config struct {
 }
 
 func (r *registry) Bind(i sync.Locker) error {
+	r.mx.Lock()
 	cfg := config{
 		rawConfig: i,
 		ident:     fmt.Sprintf("%s.%d", reflect.TypeOf(i).Elem().Name(), len(r.configs)+1),
 	}
 	err := cfg.bind(i, ``)
+	if err == nil {
+		r.configs = append(r.configs, cfg)
+	}
+	r.mx.Unlock()
 	if err != nil {
 		return err
 	}
-	r.configs = append(r.configs, cfg)
 	if r.refreshInterval != -1 {
-		r.bindChan <- struct{}{}
+		select {
+		case r.bindChan <- struct{}{}:
+		case <-r.ctx.Done():
+		}
 	}
 	return nil
 }
@@ -52,6 +59,7 @@ func (cfg *config) callOnUpdatedMethod(updatedItemKeys []string) {
 type item struct {
 	key       string // registry key
 	path      string // field path (SomeField.AnotherField.LeafField -> "SomeFieldAnotherFieldLeafField")
+	initial   string // value of the default, env and flag tags
 	reference reflect.Value
 }
 
@@ -61,6 +69,15 @@ func (i *item) equal(value interface{}) bool {
 	return reflect.DeepEqual(i.reference.Interface(), value)
 }
 
+// reset the field to the initial value, the field without the initial value is zeroed
+func (i *item) reset() {
+	if len(i.initial) == 0 || i.set(i.initial) != nil {
+		if i.reference.CanSet() {
+			i.reference.Set(reflect.Zero(i.reference.Type()))
+		}
+	}
+}
+
 func (i *item) set(rawValue string) error {
 	if len(rawValue) == 0 {
 		return nil
@@ -237,7 +254,7 @@ func makeItem(field reflect.StructField, path string, value reflect.Value) (item
 		}
 	}
 
-	new := item{key: registryKey, reference: value, path: path}
+	new := item{key: registryKey, reference: value, path: path, initial: rawValue}
 
 	if err := new.set(rawValue); err != nil {
 		return item{}, err
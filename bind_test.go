@@ -1,11 +1,15 @@
-package registry
+package registry_test
 
 import (
+	"sync"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"testing"
+
+	"github.com/trafficstars/registry"
+	_ "github.com/trafficstars/registry/memory"
 )
 
 type TestUser struct {
@@ -17,6 +21,7 @@ type TestUser struct {
 }
 
 type testConfig struct {
+	sync.Mutex
 	TestUser
 	Int          int       `default:"100"`
 	Int8         int8      `default:"100"`
@@ -47,23 +52,21 @@ type testConfig struct {
 	Duration time.Duration `default:"4m2s"`
 }
 
-func (*testConfig) Lock()   {}
-func (*testConfig) Unlock() {}
+func (c *testConfig) string() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.String
+}
 
 func Test_Bind(t *testing.T) {
-	args = []string{"--string=FlagString", "--int", "1000"}
-	var (
-		config   = testConfig{}
-		registry = registry{
-			bindChan: make(chan struct{}),
-		}
-	)
-	go func() {
-		for {
-			<-registry.bindChan
-		}
-	}()
-	if err := registry.Bind(&config); assert.NoError(t, err) {
+	r, err := registry.New("mem://", []string{"--string=FlagString", "--int", "1000"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	config := testConfig{}
+	if err := r.Bind(&config); assert.NoError(t, err) {
+		config.Lock()
+		defer config.Unlock()
 		assert.Equal(t, int(100), config.Int)
 		assert.Equal(t, int8(100), config.Int8)
 		assert.Equal(t, int16(100), config.Int16)
@@ -91,7 +94,20 @@ func Test_Bind(t *testing.T) {
 		}
 		assert.Equal(t, 4*time.Minute+2*time.Second, config.Duration)
 	}
+}
+
+func Test_BindRegistryValue(t *testing.T) {
+	r, err := registry.New("mem://", []string{"--int=1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	config := testConfig{}
+	if !assert.NoError(t, r.Bind(&config)) {
+		return
+	}
+	assert.Equal(t, "StringVar", config.string())
 
-	assert.Len(t, registry.configs, 1)
-	args = []string{}
+	// The registry value overrides the default one
+	assert.NoError(t, r.KV().Set("string.var", "registry value"))
+	assert.Eventually(t, func() bool { return config.string() == "registry value" }, 5*time.Second, 10*time.Millisecond)
 }
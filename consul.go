@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+func init() {
+	RegisterDriver("consul", newConsulBackend)
+	RegisterDriver("http", newConsulBackend)
+	RegisterDriver("https", newConsulBackend)
+}
+
+// defaultLookupTimeout of the services of the one DC in the lookup of all DCs,
+// the lookup of the single DC isn't bounded
+const defaultLookupTimeout = 5 * time.Second
+
+// newConsulBackend connects to the Consul agent defined as
+// http://127.0.0.1:8500?dc=dc1&token=secret&lookup_timeout=5, the consul:// scheme is an alias of http://
+func newConsulBackend(url *url.URL) (KV, Discovery, error) {
+	scheme := url.Scheme
+	if scheme == "consul" {
+		scheme = "http"
+	}
+	client, err := api.NewClient(&api.Config{
+		Scheme:     scheme,
+		Address:    url.Host,
+		Datacenter: url.Query().Get("dc"),
+		Token:      url.Query().Get("token"),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &discovery{
+		agent:         client.Agent(),
+		health:        client.Health(),
+		catalog:       client.Catalog(),
+		coordinate:    client.Coordinate(),
+		raw:           client.Raw(),
+		datacenter:    url.Query().Get("dc"),
+		lookupTimeout: defaultLookupTimeout,
+	}
+	if timeout := url.Query().Get("lookup_timeout"); len(timeout) != 0 {
+		if v, err := strconv.ParseInt(timeout, 10, 64); err == nil && v > 0 {
+			d.lookupTimeout = time.Duration(v) * time.Second
+		}
+	}
+	return &kv{client: client.KV()}, d, nil
+}
@@ -0,0 +1,992 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+type consulFakeKVPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// consulFake implements the subset of the Consul HTTP API
+// including the blocking queries
+type consulFake struct {
+	mx       sync.Mutex
+	index    uint64
+	catalog  uint64 // Index of the registrations of the services
+	kv       map[string]consulFakeKVPair
+	services map[string]*api.ServiceEntry
+	node     api.HealthCheck // serfHealth check of the node
+	agent    map[string]*api.AgentServiceRegistration
+	ttl      map[string]string    // TTL check ID => status
+	maint    map[string]string    // Service ID => maintenance reason
+	filters  []string             // Filter expressions of the catalog and health requests
+	dcs      map[string]string    // Datacenter => state ("ok", "broken", "stalled" or "slow")
+	coords   map[string][]float64 // Node => coordinate vector
+	stallDCs bool                 // The datacenters list isn't responded
+	changed  chan struct{}
+	closed   chan struct{}
+	requests int32
+	items    int32 // Requests of the instances of the catalog service
+}
+
+func runConsulFake(t *testing.T) (*consulFake, string) {
+	fake := &consulFake{
+		index:    1,
+		catalog:  1,
+		kv:       map[string]consulFakeKVPair{},
+		services: map[string]*api.ServiceEntry{},
+		agent:    map[string]*api.AgentServiceRegistration{},
+		ttl:      map[string]string{},
+		maint:    map[string]string{},
+		dcs:      map[string]string{"dc1": "ok"},
+		node:     api.HealthCheck{Node: "node-1", CheckID: "serfHealth", Name: "Serf Health Status", Status: api.HealthPassing},
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(fake.closed) }) // Release the blocking queries before the server closing
+	return fake, strings.TrimPrefix(server.URL, "http://")
+}
+
+// commit increments the index and wakes up the blocking queries, mx must be locked
+func (c *consulFake) commit() uint64 {
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return c.index
+}
+
+// wait blocks until the index is changed or the wait time is over, returns locked mx
+func (c *consulFake) wait(req *http.Request) {
+	c.waitIndex(req, &c.index)
+}
+
+// waitIndex blocks until the current index is changed or the wait time is over, returns locked mx
+func (c *consulFake) waitIndex(req *http.Request, current *uint64) {
+	c.mx.Lock()
+	index, _ := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64)
+	wait, err := time.ParseDuration(req.URL.Query().Get("wait"))
+	if err != nil || wait <= 0 {
+		wait = 5 * time.Minute
+	}
+	timeout := time.After(wait)
+	for index != 0 && index == *current {
+		changed := c.changed
+		c.mx.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			c.mx.Lock()
+			return
+		case <-c.closed:
+			c.mx.Lock()
+			return
+		}
+		c.mx.Lock()
+	}
+}
+
+func (c *consulFake) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&c.requests, 1)
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v1/kv/"):
+		c.serveKV(rw, req, strings.TrimPrefix(req.URL.Path, "/v1/kv/"))
+	case req.URL.Path == "/v1/agent/service/register":
+		var registration api.AgentServiceRegistration
+		if err := json.NewDecoder(req.Body).Decode(&registration); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mx.Lock()
+		c.agent[registration.ID] = &registration
+		c.mx.Unlock()
+	case strings.HasPrefix(req.URL.Path, "/v1/agent/service/deregister/"):
+		c.mx.Lock()
+		delete(c.agent, strings.TrimPrefix(req.URL.Path, "/v1/agent/service/deregister/"))
+		c.mx.Unlock()
+	case strings.HasPrefix(req.URL.Path, "/v1/agent/service/maintenance/"):
+		id := strings.TrimPrefix(req.URL.Path, "/v1/agent/service/maintenance/")
+		c.mx.Lock()
+		if req.URL.Query().Get("enable") == "true" {
+			c.maint[id] = req.URL.Query().Get("reason")
+		} else {
+			delete(c.maint, id)
+		}
+		c.commit()
+		c.mx.Unlock()
+	case strings.HasPrefix(req.URL.Path, "/v1/agent/check/update/"):
+		var update struct{ Status, Output string }
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mx.Lock()
+		c.ttl[strings.TrimPrefix(req.URL.Path, "/v1/agent/check/update/")] = update.Status + ":" + update.Output
+		c.mx.Unlock()
+	case req.URL.Path == "/v1/agent/self":
+		json.NewEncoder(rw).Encode(map[string]map[string]interface{}{"Config": {"NodeName": c.node.Node}})
+	case req.URL.Path == "/v1/coordinate/nodes":
+		c.mx.Lock()
+		entries := make([]map[string]interface{}, 0, len(c.coords))
+		for node, vec := range c.coords {
+			entries = append(entries, map[string]interface{}{
+				"Node":  node,
+				"Coord": map[string]interface{}{"Vec": vec, "Error": 0.1, "Adjustment": 0, "Height": 0},
+			})
+		}
+		c.mx.Unlock()
+		json.NewEncoder(rw).Encode(entries)
+	case req.URL.Path == "/v1/catalog/datacenters":
+		c.mx.Lock()
+		if c.stallDCs {
+			c.mx.Unlock()
+			select {
+			case <-req.Context().Done():
+			case <-c.closed:
+			}
+			return
+		}
+		dcs := make([]string, 0, len(c.dcs))
+		for dc := range c.dcs {
+			dcs = append(dcs, dc)
+		}
+		c.mx.Unlock()
+		sort.Strings(dcs)
+		json.NewEncoder(rw).Encode(dcs)
+	case !c.available(rw, req):
+	case req.URL.Path == "/v1/catalog/services":
+		c.serveCatalogServices(rw, req)
+	case strings.HasPrefix(req.URL.Path, "/v1/catalog/service/"):
+		c.serveCatalogService(rw, req, strings.TrimPrefix(req.URL.Path, "/v1/catalog/service/"))
+	case req.URL.Path == "/v1/health/state/any":
+		c.serveHealthState(rw, req)
+	case strings.HasPrefix(req.URL.Path, "/v1/health/service/"):
+		c.serveHealthService(rw, req, strings.TrimPrefix(req.URL.Path, "/v1/health/service/"))
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (c *consulFake) serveKV(rw http.ResponseWriter, req *http.Request, key string) {
+	switch req.Method {
+	case http.MethodPut:
+		value, _ := ioutil.ReadAll(req.Body)
+		c.mx.Lock()
+		c.kv[key] = consulFakeKVPair{Key: key, Value: value, ModifyIndex: c.commit()}
+		c.mx.Unlock()
+		rw.Write([]byte("true"))
+		return
+	case http.MethodDelete:
+		c.mx.Lock()
+		delete(c.kv, key)
+		c.commit()
+		c.mx.Unlock()
+		rw.Write([]byte("true"))
+		return
+	}
+
+	c.wait(req)
+	defer c.mx.Unlock()
+
+	var pairs []consulFakeKVPair
+	_, recurse := req.URL.Query()["recurse"]
+	for k, pair := range c.kv {
+		if k == key || (recurse && strings.HasPrefix(k, key)) {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	if len(pairs) == 0 {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(rw).Encode(pairs)
+}
+
+// setService adds or replaces the service instance with the service checks of the statuses
+func (c *consulFake) setService(srv Service, statuses ...string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	entry := &api.ServiceEntry{
+		Node: &api.Node{Node: "node-1", Datacenter: srv.Datacenter},
+		Service: &api.AgentService{
+			ID:      srv.ID,
+			Service: srv.Name,
+			Address: srv.Address,
+			Port:    srv.Port,
+			Tags:    srv.Tags,
+			Meta:    srv.Meta,
+		},
+	}
+	for i, status := range statuses {
+		entry.Checks = append(entry.Checks, &api.HealthCheck{
+			Node:      "node-1",
+			CheckID:   "service:" + srv.ID + ":" + strconv.Itoa(i+1),
+			ServiceID: srv.ID,
+			Status:    status,
+		})
+	}
+	c.services[srv.ID] = entry
+	c.catalog = c.commit()
+}
+
+// setNodeStatus changes the status of the node check
+func (c *consulFake) setNodeStatus(status string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.node.Status = status
+	c.commit()
+}
+
+func (c *consulFake) serveHealthService(rw http.ResponseWriter, req *http.Request, name string) {
+	c.wait(req)
+	defer c.mx.Unlock()
+
+	if filter := req.URL.Query().Get("filter"); filter != "" {
+		c.filters = append(c.filters, filter)
+	}
+	var (
+		_, passing = req.URL.Query()["passing"]
+		tags       = req.URL.Query()["tag"]
+		entries    = []*api.ServiceEntry{}
+	)
+	for _, srv := range c.services {
+		entry := *srv
+		entry.Checks = append(api.HealthChecks{&c.node}, srv.Checks...)
+		if reason, ok := c.maint[srv.Service.ID]; ok {
+			entry.Checks = append(entry.Checks, &api.HealthCheck{
+				Node:      "node-1",
+				CheckID:   api.ServiceMaintPrefix + srv.Service.ID,
+				ServiceID: srv.Service.ID,
+				Status:    api.HealthCritical,
+				Notes:     reason,
+			})
+		}
+		if entry.Service.Service != name || (passing && entry.Checks.AggregatedStatus() != api.HealthPassing) {
+			continue
+		}
+		var missed bool
+		for _, tag := range tags {
+			missed = missed || !hasTag(entry.Service.Tags, tag)
+		}
+		if missed {
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Service.ID < entries[j].Service.ID })
+
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(rw).Encode(entries)
+}
+
+// available returns false if the requested datacenter is broken or stalled,
+// the slow datacenter answers in 1.5 seconds
+func (c *consulFake) available(rw http.ResponseWriter, req *http.Request) bool {
+	c.mx.Lock()
+	state := c.dcs[req.URL.Query().Get("dc")]
+	c.mx.Unlock()
+	switch state {
+	case "broken":
+		http.Error(rw, "datacenter is broken", http.StatusInternalServerError)
+		return false
+	case "stalled":
+		select {
+		case <-req.Context().Done():
+		case <-c.closed:
+		}
+		return false
+	case "slow":
+		select {
+		case <-time.After(1500 * time.Millisecond):
+		case <-req.Context().Done():
+			return false
+		}
+	}
+	return true
+}
+
+// inDatacenter returns true if the entry belongs to the requested datacenter
+func inDatacenter(req *http.Request, entry *api.ServiceEntry) bool {
+	dc := req.URL.Query().Get("dc")
+	return dc == "" || dc == entry.Node.Datacenter
+}
+
+func (c *consulFake) serveCatalogServices(rw http.ResponseWriter, req *http.Request) {
+	c.waitIndex(req, &c.catalog)
+	defer c.mx.Unlock()
+	services := map[string][]string{}
+	for _, entry := range c.services {
+		if !inDatacenter(req, entry) {
+			continue
+		}
+		services[entry.Service.Service] = append(services[entry.Service.Service], entry.Service.Tags...)
+	}
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(c.catalog, 10))
+	json.NewEncoder(rw).Encode(services)
+}
+
+// serveCatalogService records the filter expression, but doesn't evaluate it
+func (c *consulFake) serveCatalogService(rw http.ResponseWriter, req *http.Request, name string) {
+	atomic.AddInt32(&c.items, 1)
+	c.wait(req)
+	defer c.mx.Unlock()
+	if filter := req.URL.Query().Get("filter"); filter != "" {
+		c.filters = append(c.filters, filter)
+	}
+	services := []*api.CatalogService{}
+	for _, entry := range c.services {
+		if entry.Service.Service != name || !inDatacenter(req, entry) {
+			continue
+		}
+		services = append(services, &api.CatalogService{
+			Node:           entry.Node.Node,
+			Datacenter:     entry.Node.Datacenter,
+			ServiceID:      entry.Service.ID,
+			ServiceName:    entry.Service.Service,
+			ServiceAddress: entry.Service.Address,
+			ServicePort:    entry.Service.Port,
+			ServiceTags:    entry.Service.Tags,
+			ServiceMeta:    entry.Service.Meta,
+		})
+	}
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(rw).Encode(services)
+}
+
+func (c *consulFake) serveHealthState(rw http.ResponseWriter, req *http.Request) {
+	c.wait(req)
+	defer c.mx.Unlock()
+	checks := api.HealthChecks{&c.node}
+	for _, entry := range c.services {
+		if inDatacenter(req, entry) {
+			checks = append(checks, entry.Checks...)
+		}
+	}
+	rw.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	json.NewEncoder(rw).Encode(checks)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type testWatchConfig struct {
+	sync.Mutex
+	Name string `default:"default" registry:"service/name"`
+}
+
+func (c *testWatchConfig) name() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.Name
+}
+
+func Test_ConsulBlockingRefresh(t *testing.T) {
+	fake, address := runConsulFake(t)
+	r, err := New("http://"+address+"?refresh_interval=30", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	config := &testWatchConfig{}
+	if !assert.NoError(t, r.Bind(config)) {
+		return
+	}
+	assert.Equal(t, "default", config.name())
+
+	// The change is delivered long before the refresh interval
+	assert.NoError(t, r.KV().Set("service/name", "changed"))
+	assert.Eventually(t, func() bool { return config.name() == "changed" }, 5*time.Second, 10*time.Millisecond)
+
+	// The deleted key returns the default value
+	assert.NoError(t, r.KV().Delete("service/name"))
+	assert.Eventually(t, func() bool { return config.name() == "default" }, 5*time.Second, 10*time.Millisecond)
+
+	// Idle registry waits in the blocking query instead of polling
+	requests := atomic.LoadInt32(&fake.requests)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, requests, atomic.LoadInt32(&fake.requests))
+}
+
+func nextEvent(t *testing.T, events <-chan KVEvent) KVEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return KVEvent{}
+}
+
+func Test_ConsulWatch(t *testing.T) {
+	_, address := runConsulFake(t)
+	r, err := New("http://"+address, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	kv := r.KV()
+	kv.Set("flags/a", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	keyEvents, err := kv.Watch(ctx, "flags/b")
+	if !assert.NoError(t, err) {
+		return
+	}
+	prefixEvents, err := kv.WatchPrefix(ctx, RegistryPrefix+"/flags/")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The current value is the first event
+	event := nextEvent(t, prefixEvents)
+	assert.Equal(t, KVEvent{Type: KV_EVENT_PUT, Key: RegistryPrefix + "/flags/a", Value: "1", ModifyIndex: 2}, event)
+
+	kv.Set("flags/b", "2")
+	event = nextEvent(t, keyEvents)
+	assert.Equal(t, KVEvent{Type: KV_EVENT_PUT, Key: RegistryPrefix + "/flags/b", Value: "2", ModifyIndex: 3}, event)
+	assert.Equal(t, event, nextEvent(t, prefixEvents))
+
+	kv.Delete("flags/a")
+	event = nextEvent(t, prefixEvents)
+	assert.Equal(t, KVEvent{Type: KV_EVENT_DELETE, Key: RegistryPrefix + "/flags/a", ModifyIndex: 4}, event)
+
+	cancel()
+	for range keyEvents {
+	}
+	for range prefixEvents {
+	}
+}
+
+func Test_ConsulDiscoveryWatch(t *testing.T) {
+	fake, address := runConsulFake(t)
+	r, err := New("http://"+address, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1", Address: "10.0.0.1", Port: 80}, api.HealthPassing)
+	fake.setService(Service{ID: "db-1", Name: "db", Datacenter: "dc1", Address: "10.0.0.2", Port: 5432}, api.HealthPassing)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := r.Discovery().Watch(ctx, &Filter{Service: "api"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	next := func() []Service {
+		select {
+		case services := <-updates:
+			return services
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update")
+		}
+		return nil
+	}
+
+	if services := next(); assert.Len(t, services, 1) {
+		assert.Equal(t, Service{
+			ID:         "api-1",
+			Name:       "api",
+			Datacenter: "dc1",
+			Node:       "node-1",
+			Address:    "10.0.0.1",
+			Port:       80,
+			Status:     SERVICE_STATUS_PASSING,
+			Checks: []CheckStatus{
+				{ID: "serfHealth", Name: "Serf Health Status", Status: SERVICE_STATUS_PASSING},
+				{ID: "service:api-1:1", ServiceID: "api-1", Status: SERVICE_STATUS_PASSING},
+			},
+		}, services[0])
+	}
+
+	fake.setService(Service{ID: "api-2", Name: "api", Datacenter: "dc1", Address: "10.0.0.3", Port: 80}, api.HealthPassing)
+	if services := next(); assert.Len(t, services, 2) {
+		assert.Equal(t, "api-2", services[1].ID)
+	}
+
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1", Address: "10.0.0.1", Port: 80}, api.HealthCritical)
+	if services := next(); assert.Len(t, services, 1) {
+		assert.Equal(t, "api-2", services[0].ID)
+	}
+
+	cancel()
+	for range updates {
+	}
+}
+
+func Test_ConsulLookupService(t *testing.T) {
+	fake, address := runConsulFake(t)
+	// The backend is used directly, so the registry supervisor doesn't send the requests
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.setService(Service{ID: "api-2", Name: "api", Datacenter: "dc1", Address: "10.0.0.2", Port: 80, Tags: []string{"http"}}, api.HealthCritical)
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1", Address: "10.0.0.1", Port: 80, Tags: []string{"http"}}, api.HealthPassing)
+	fake.setService(Service{ID: "api-3", Name: "api", Datacenter: "dc1", Address: "10.0.0.3", Port: 80, Meta: map[string]string{"version": "2"}}, api.HealthPassing)
+	fake.setService(Service{ID: "db-1", Name: "db", Datacenter: "dc1", Address: "10.0.0.4", Port: 5432}, api.HealthPassing)
+
+	// The instances of the service are fetched by the single request
+	requests := atomic.LoadInt32(&fake.requests)
+	services, err := discovery.Lookup(&Filter{Service: "api", Tags: []string{"http"}})
+	if assert.NoError(t, err) && assert.Len(t, services, 2) {
+		assert.Equal(t, "api-1", services[0].ID)
+		assert.Equal(t, SERVICE_STATUS_PASSING, services[0].Status)
+		assert.Equal(t, "api-2", services[1].ID)
+		assert.Equal(t, SERVICE_STATUS_CRITICAL, services[1].Status)
+	}
+	assert.Equal(t, requests+1, atomic.LoadInt32(&fake.requests))
+
+	services, err = discovery.Lookup(&Filter{Service: "api", Status: SERVICE_STATUS_PASSING})
+	if assert.NoError(t, err) && assert.Len(t, services, 2) {
+		assert.Equal(t, "api-1", services[0].ID)
+		assert.Equal(t, "api-3", services[1].ID)
+	}
+
+	services, err = discovery.Lookup(&Filter{Service: "api", AllTags: []string{"http", "h*"}, ExcludeTags: []string{"drain"}})
+	if assert.NoError(t, err) {
+		assert.Len(t, services, 2)
+	}
+
+	services, err = discovery.Lookup(&Filter{Service: "api", Meta: map[string]string{"version": "2"}})
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, map[string]string{"version": "2"}, services[0].Meta)
+	}
+}
+
+func Test_ConsulCheckStatus(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1"}, api.HealthPassing, api.HealthCritical)
+	fake.setService(Service{ID: "api-2", Name: "api", Datacenter: "dc1"}, api.HealthWarning, api.HealthPassing)
+	fake.setService(Service{ID: "api-3", Name: "api", Datacenter: "dc1"})
+
+	// The worst check defines the status, the node check is the only one of the api-3
+	services, err := discovery.Lookup(&Filter{Service: "api"})
+	if assert.NoError(t, err) && assert.Len(t, services, 3) {
+		assert.Equal(t, SERVICE_STATUS_CRITICAL, services[0].Status)
+		assert.Len(t, services[0].Checks, 3)
+		assert.Equal(t, SERVICE_STATUS_WARNING, services[1].Status)
+		assert.Equal(t, SERVICE_STATUS_PASSING, services[2].Status)
+		assert.Len(t, services[2].Checks, 1)
+	}
+
+	fake.setNodeStatus(api.HealthCritical)
+	services, err = discovery.Lookup(&Filter{Service: "api"})
+	if assert.NoError(t, err) && assert.Len(t, services, 3) {
+		for _, srv := range services {
+			assert.Equal(t, SERVICE_STATUS_CRITICAL, srv.Status, srv.ID)
+		}
+	}
+}
+
+func Test_ConsulRegisterChecks(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = discovery.Register(ServiceOptions{
+		ID:      "api-1",
+		Name:    "api",
+		Address: "127.0.0.1:8080",
+		Check:   CheckOptions{TTL: "10s", Interval: "5s"},
+		Checks: []CheckOptions{
+			{
+				HTTP:          "https://127.0.0.1:8080/check",
+				Method:        http.MethodHead,
+				Header:        map[string][]string{"X-Check": {"1"}},
+				TLSSkipVerify: true,
+				Interval:      "5s",
+			},
+			{ID: "grpc", Name: "gRPC health", GRPC: "127.0.0.1:8081/api", Interval: "5s", DeregisterAfter: "1m"},
+			{AliasService: "db"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fake.mx.Lock()
+	defer fake.mx.Unlock()
+	registration := fake.agent["api-1"]
+	if assert.NotNil(t, registration) && assert.Len(t, registration.Checks, 4) {
+		checks := registration.Checks
+		assert.Equal(t, &api.AgentServiceCheck{
+			CheckID:                        "api-1",
+			Name:                           "api health status",
+			TTL:                            "10s",
+			DeregisterCriticalServiceAfter: "10m",
+		}, checks[0])
+		assert.Equal(t, &api.AgentServiceCheck{
+			CheckID:                        "api-1:1",
+			Name:                           "api health status 1",
+			Interval:                       "5s",
+			HTTP:                           "https://127.0.0.1:8080/check",
+			Method:                         http.MethodHead,
+			Header:                         map[string][]string{"X-Check": {"1"}},
+			TLSSkipVerify:                  true,
+			DeregisterCriticalServiceAfter: "10m",
+		}, checks[1])
+		assert.Equal(t, "grpc", checks[2].CheckID)
+		assert.Equal(t, "gRPC health", checks[2].Name)
+		assert.Equal(t, "127.0.0.1:8081/api", checks[2].GRPC)
+		assert.Equal(t, "1m", checks[2].DeregisterCriticalServiceAfter)
+		assert.Equal(t, "api-1:3", checks[3].CheckID)
+		assert.Equal(t, "db", checks[3].AliasService)
+	}
+}
+
+func Test_ConsulUpdateTTL(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	health := func() (int8, string) { return SERVICE_STATUS_WARNING, "queue is full" }
+	if assert.NoError(t, Heartbeat(ctx, discovery, "worker-1", time.Minute, health)) {
+		fake.mx.Lock()
+		assert.Equal(t, map[string]string{"worker-1": api.HealthWarning + ":queue is full"}, fake.ttl)
+		fake.mx.Unlock()
+	}
+	assert.Error(t, discovery.(TTLUpdater).UpdateTTL("worker-1", SERVICE_STATUS_UNDEFINED, ""))
+}
+
+func Test_ConsulServiceHandle(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	state := func(id string) (registered bool, reason string) {
+		fake.mx.Lock()
+		defer fake.mx.Unlock()
+		_, registered = fake.agent[id]
+		return registered, fake.maint[id]
+	}
+
+	handle, err := RegisterService(discovery, ServiceOptions{ID: "api-1", Name: "api", Address: "127.0.0.1:8080"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "api-1", handle.ID())
+	if assert.NoError(t, handle.Drain()) {
+		registered, reason := state("api-1")
+		assert.True(t, registered)
+		assert.Equal(t, DrainReason, reason)
+	}
+	assert.NoError(t, handle.Close())
+	assert.NoError(t, handle.Close())
+	registered, _ := state("api-1")
+	assert.False(t, registered)
+
+	// The signal is caught by the test too, so the process is not terminated
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	handle, err = RegisterService(discovery, ServiceOptions{ID: "api-2", Name: "api", Address: "127.0.0.1:8080"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	handle.CloseOnSignal(100*time.Millisecond, syscall.SIGHUP)
+	process, _ := os.FindProcess(os.Getpid())
+	process.Signal(syscall.SIGHUP)
+
+	assert.Eventually(t, func() bool {
+		_, reason := state("api-2")
+		return reason == DrainReason
+	}, time.Second, time.Millisecond)
+	registered, _ = state("api-2")
+	assert.True(t, registered, "deregistered before the drain delay")
+
+	select {
+	case <-handle.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the service is not deregistered")
+	}
+	registered, _ = state("api-2")
+	assert.False(t, registered)
+}
+
+func Test_ConsulMaintenance(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1"}, api.HealthPassing)
+
+	if assert.NoError(t, discovery.EnableMaintenance("api-1", "upgrade")) {
+		services, err := discovery.Lookup(&Filter{Service: "api"})
+		if assert.NoError(t, err) && assert.Len(t, services, 1) {
+			assert.True(t, services[0].Maintenance)
+			assert.Equal(t, SERVICE_STATUS_CRITICAL, services[0].Status)
+		}
+	}
+	if assert.NoError(t, discovery.DisableMaintenance("api-1")) {
+		services, err := discovery.Lookup(&Filter{Service: "api"})
+		if assert.NoError(t, err) && assert.Len(t, services, 1) {
+			assert.False(t, services[0].Maintenance)
+			assert.Equal(t, SERVICE_STATUS_PASSING, services[0].Status)
+		}
+	}
+}
+
+func Test_ConsulLookupExpression(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1", Tags: []string{"gpu"}, Meta: map[string]string{"version": "2"}}, api.HealthPassing)
+	fake.setService(Service{ID: "api-2", Name: "api", Datacenter: "dc1", Meta: map[string]string{"version": "2"}}, api.HealthCritical)
+	fake.setService(Service{ID: "db-1", Name: "db", Datacenter: "dc1", Tags: []string{"gpu"}}, api.HealthPassing)
+
+	expression := `ServiceMeta.version == "2" and "gpu" in ServiceTags`
+	services, err := discovery.Lookup(&Filter{Expression: expression})
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "api-1", services[0].ID)
+		assert.Equal(t, SERVICE_STATUS_PASSING, services[0].Status)
+	}
+	fake.mx.Lock()
+	assert.Equal(t, []string{expression, expression}, fake.filters, "the expression is forwarded to every catalog request")
+	fake.mx.Unlock()
+
+	// The instances of the one service are filtered by the health selectors
+	services, err = discovery.Lookup(&Filter{Service: "api", Expression: `ServiceID != "api-1" and ServiceMeta.version == "2"`})
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "api-2", services[0].ID)
+		assert.Equal(t, SERVICE_STATUS_CRITICAL, services[0].Status)
+	}
+	fake.mx.Lock()
+	assert.Equal(t, `Service.ID != "api-1" and Service.Meta.version == "2"`, fake.filters[len(fake.filters)-1], "the expression is forwarded to the agent")
+	fake.mx.Unlock()
+
+	_, err = discovery.Lookup(&Filter{Expression: "ServiceMeta.version =="})
+	assert.Error(t, err)
+	_, err = discovery.Lookup(&Filter{Expression: `NodeMeta.rack == "a"`})
+	assert.Error(t, err, "the unsupported selector is rejected instead of matching nothing")
+}
+
+func Test_ConsulLookupDatacenters(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address, RawQuery: "lookup_timeout=1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.mx.Lock()
+	fake.dcs = map[string]string{"dc1": "ok", "dc2": "ok", "dc3": "broken", "dc4": "stalled"}
+	fake.mx.Unlock()
+	for _, dc := range []string{"dc1", "dc2", "dc3", "dc4"} {
+		fake.setService(Service{ID: "api-" + dc, Name: "api", Datacenter: dc}, api.HealthPassing)
+	}
+
+	filter := &Filter{Service: "api", Datacenter: "all"}
+	start := time.Now()
+	services, err := discovery.Lookup(filter)
+	assert.Less(t, time.Since(start), 3*time.Second, "the datacenters are polled concurrently")
+	assert.Equal(t, "all", filter.Datacenter, "the filter is not changed")
+
+	if assert.Len(t, services, 2) {
+		assert.Equal(t, "api-dc1", services[0].ID)
+		assert.Equal(t, "api-dc2", services[1].ID)
+	}
+	if partial, ok := err.(*PartialLookupError); assert.True(t, ok, "%v", err) {
+		assert.Len(t, partial.Errors, 2)
+		assert.Contains(t, partial.Errors, "dc3")
+		assert.Contains(t, partial.Errors, "dc4")
+		assert.Contains(t, partial.Error(), "datacenter dc3 lookup")
+	}
+}
+
+func Test_ConsulLookupTimeout(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address, RawQuery: "lookup_timeout=1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.mx.Lock()
+	fake.dcs = map[string]string{"dc1": "slow", "dc2": "broken"}
+	fake.mx.Unlock()
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1"}, api.HealthPassing)
+
+	services, err := discovery.Lookup(&Filter{Service: "api", Datacenter: "dc1"})
+	if assert.NoError(t, err, "the lookup of the single DC isn't bounded by the timeout") {
+		assert.Len(t, services, 1)
+	}
+
+	_, err = discovery.Lookup(&Filter{Service: "api", Datacenter: "all"})
+	var partial *PartialLookupError
+	if assert.ErrorAs(t, err, &partial) {
+		assert.Len(t, partial.Errors, 2)
+	}
+}
+
+func Test_ConsulCoordinates(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.mx.Lock()
+	fake.coords = map[string][]float64{"node-1": {0, 0}, "node-2": {0.003, 0.004}}
+	fake.mx.Unlock()
+	fake.setService(Service{ID: "api-1", Name: "api", Datacenter: "dc1"}, api.HealthPassing)
+
+	services, err := discovery.Lookup(&Filter{Service: "api"})
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "node-1", services[0].Node)
+	}
+
+	local, nodes, err := discovery.(CoordinateProvider).Coordinates()
+	if assert.NoError(t, err) && assert.Len(t, nodes, 2) {
+		assert.Equal(t, time.Duration(0), local.DistanceTo(nodes["node-1"]))
+		assert.Equal(t, 5*time.Millisecond, local.DistanceTo(nodes["node-2"]))
+	}
+}
+
+func Test_ConsulWatchDatacenters(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address, RawQuery: "lookup_timeout=1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.mx.Lock()
+	fake.dcs = map[string]string{"dc1": "ok", "dc2": "ok", "dc3": "broken"}
+	fake.mx.Unlock()
+	for _, dc := range []string{"dc1", "dc2", "dc3"} {
+		fake.setService(Service{ID: "api-" + dc, Name: "api", Datacenter: dc}, api.HealthPassing)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := discovery.Watch(ctx, &Filter{Service: "api", Datacenter: "all"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The broken datacenter doesn't block the services of the other ones
+	select {
+	case services := <-updates:
+		if assert.Len(t, services, 2) {
+			assert.Equal(t, "api-dc1", services[0].ID)
+			assert.Equal(t, "api-dc2", services[1].ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update")
+	}
+
+	// The datacenters list is bounded by the lookup timeout
+	fake.mx.Lock()
+	fake.stallDCs = true
+	fake.mx.Unlock()
+	start := time.Now()
+	_, err = discovery.Lookup(&Filter{Datacenter: "all"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 3*time.Second)
+
+	// The lookup of the only failed datacenters isn't partial
+	fake.mx.Lock()
+	fake.stallDCs = false
+	fake.dcs = map[string]string{"dc3": "broken"}
+	fake.mx.Unlock()
+	services, err := discovery.Lookup(&Filter{Datacenter: "all"})
+	assert.Empty(t, services)
+	if assert.Error(t, err) {
+		_, ok := err.(*PartialLookupError)
+		assert.False(t, ok)
+	}
+}
+
+func Test_ConsulWatchAllServices(t *testing.T) {
+	fake, address := runConsulFake(t)
+	_, discovery, err := newConsulBackend(&url.URL{Scheme: "http", Host: address, RawQuery: "lookup_timeout=1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	fake.mx.Lock()
+	fake.dcs = map[string]string{"dc1": "ok", "dc2": "ok"}
+	fake.mx.Unlock()
+	fake.setService(Service{ID: "api-dc1", Name: "api", Datacenter: "dc1"}, api.HealthPassing)
+	fake.setService(Service{ID: "db-dc2", Name: "db", Datacenter: "dc2"}, api.HealthPassing)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := discovery.Watch(ctx, &Filter{Datacenter: "all"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The datacenters are updated independently, so the intermediate states are skipped
+	waitFor := func(expected ...string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case services := <-updates:
+				ids := []string{}
+				for _, srv := range services {
+					ids = append(ids, srv.ID)
+				}
+				if assert.ObjectsAreEqual(append([]string{}, expected...), ids) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no update with %v", expected)
+			}
+		}
+	}
+	waitFor("api-dc1", "db-dc2")
+
+	// The registration in the remote DC is pushed by its own blocking query
+	fake.setService(Service{ID: "api-dc2", Name: "api", Datacenter: "dc2"}, api.HealthPassing)
+	waitFor("api-dc1", "api-dc2", "db-dc2")
+
+	// The change of a check doesn't fetch the catalog again
+	items := atomic.LoadInt32(&fake.items)
+	fake.setNodeStatus(api.HealthCritical)
+	waitFor()
+	fake.setNodeStatus(api.HealthPassing)
+	waitFor("api-dc1", "api-dc2", "db-dc2")
+	assert.Equal(t, items, atomic.LoadInt32(&fake.items))
+
+	cancel()
+	for range updates {
+	}
+}
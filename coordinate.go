@@ -0,0 +1,43 @@
+package registry
+
+import (
+	"math"
+	"time"
+)
+
+// UnknownDistance between the nodes without compatible coordinates
+const UnknownDistance = time.Duration(math.MaxInt64)
+
+// Coordinate of the node in the Vivaldi network coordinate system
+// which is maintained by Consul
+type Coordinate struct {
+	Vec        []float64
+	Error      float64
+	Adjustment float64
+	Height     float64
+}
+
+// CoordinateProvider is implemented by the Discovery backends which know
+// the network coordinates of the nodes of the local datacenter
+type CoordinateProvider interface {
+	// Coordinates returns the coordinate of the local node
+	// and the coordinates of the nodes by the node name
+	Coordinates() (local *Coordinate, nodes map[string]*Coordinate, err error)
+}
+
+// DistanceTo returns the estimated round trip time to the other node
+// as Consul calculates it, or UnknownDistance if the coordinates are not compatible
+func (c *Coordinate) DistanceTo(other *Coordinate) time.Duration {
+	if c == nil || other == nil || len(c.Vec) != len(other.Vec) {
+		return UnknownDistance
+	}
+	var sum float64
+	for i := range c.Vec {
+		sum += (c.Vec[i] - other.Vec[i]) * (c.Vec[i] - other.Vec[i])
+	}
+	dist := math.Sqrt(sum) + c.Height + other.Height
+	if adjusted := dist + c.Adjustment + other.Adjustment; adjusted > 0 {
+		dist = adjusted
+	}
+	return time.Duration(dist * float64(time.Second))
+}
@@ -0,0 +1,25 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CoordinateDistance(t *testing.T) {
+	tests := []struct {
+		a, b     *Coordinate
+		distance time.Duration
+	}{
+		{a: &Coordinate{Vec: []float64{0, 0}}, b: &Coordinate{Vec: []float64{0.003, 0.004}}, distance: 5 * time.Millisecond},
+		{a: &Coordinate{Vec: []float64{0, 0}, Height: 0.001}, b: &Coordinate{Vec: []float64{0.003, 0.004}, Height: 0.001}, distance: 7 * time.Millisecond},
+		{a: &Coordinate{Vec: []float64{0}, Adjustment: 0.002}, b: &Coordinate{Vec: []float64{0.001}, Adjustment: 0.001}, distance: 4 * time.Millisecond},
+		{a: &Coordinate{Vec: []float64{0}, Adjustment: -0.002}, b: &Coordinate{Vec: []float64{0.001}}, distance: time.Millisecond},
+		{a: &Coordinate{Vec: []float64{0}}, b: &Coordinate{Vec: []float64{0, 0}}, distance: UnknownDistance},
+		{a: &Coordinate{Vec: []float64{0}}, b: nil, distance: UnknownDistance},
+	}
+	for _, test := range tests {
+		assert.InDelta(t, float64(test.distance), float64(test.a.DistanceTo(test.b)), float64(time.Microsecond))
+	}
+}
@@ -1,49 +1,34 @@
 package registry
 
 import (
+	"context"
 	"fmt"
-	"net"
-	"net/url"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 )
 
 type discovery struct {
-	agent      *api.Agent
-	health     *api.Health
-	catalog    *api.Catalog
-	datacenter string
+	agent         *api.Agent
+	health        *api.Health
+	catalog       *api.Catalog
+	coordinate    *api.Coordinate
+	raw           *api.Raw
+	datacenter    string
+	lookupTimeout time.Duration // Timeout of the lookup of the one DC
+
+	nodeNameOnce sync.Once
+	nodeName     string
+	nodeNameErr  error
 }
 
 func (d *discovery) Register(options ServiceOptions) error {
-	var (
-		host = options.Address
-		port int
-	)
-	if strings.HasPrefix(host, "http") {
-		url, err := url.Parse(host)
-		if err != nil {
-			return err
-		}
-		host = url.Host
-	}
-	if strings.Contains(host, ":") {
-		h, p, err := net.SplitHostPort(host)
-		if err != nil {
-			return err
-		}
-		v, err := strconv.ParseUint(p, 10, 32)
-		if err != nil {
-			return err
-		}
-		host = h
-		port = int(v)
-	}
-	if options.Check.DeregisterAfter == "" {
-		options.Check.DeregisterAfter = "10m"
+	host, port, err := SplitServiceAddress(options.Address)
+	if err != nil {
+		return err
 	}
 	fmt.Println("Register", options.Name, options.ID)
 	agentService := api.AgentServiceRegistration{
@@ -52,28 +37,116 @@ func (d *discovery) Register(options ServiceOptions) error {
 		Address:           host,
 		Port:              port,
 		Tags:              append(options.Tags, "DC="+d.datacenter),
+		Meta:              options.Meta,
 		EnableTagOverride: true,
-		Check:             nil,
-	}
-	if options.Check.HTTP != "" || options.Check.TCP != "" {
-		agentService.Check = &api.AgentServiceCheck{
-			CheckID:                        options.ID,
-			Name:                           fmt.Sprintf("%s health status", options.Name),
-			Interval:                       options.Check.Interval,
-			Timeout:                        options.Check.Timeout,
-			HTTP:                           options.Check.HTTP,
-			TCP:                            options.Check.TCP,
-			TTL:                            options.Check.TTL,
-			DeregisterCriticalServiceAfter: options.Check.DeregisterAfter,
-		}
+	}
+	for _, check := range options.HealthChecks() {
+		agentService.Checks = append(agentService.Checks, agentServiceCheck(check))
 	}
 	return d.agent.ServiceRegister(&agentService)
 }
 
+func agentServiceCheck(check CheckOptions) *api.AgentServiceCheck {
+	if check.DeregisterAfter == "" {
+		check.DeregisterAfter = "10m"
+	}
+	agentCheck := &api.AgentServiceCheck{
+		CheckID:                        check.ID,
+		Name:                           check.Name,
+		Interval:                       check.Interval,
+		Timeout:                        check.Timeout,
+		DeregisterCriticalServiceAfter: check.DeregisterAfter,
+	}
+	switch {
+	case check.HTTP != "":
+		agentCheck.HTTP = check.HTTP
+		agentCheck.Method = check.Method
+		agentCheck.Header = check.Header
+		agentCheck.TLSSkipVerify = check.TLSSkipVerify
+	case check.TCP != "":
+		agentCheck.TCP = check.TCP
+	case check.GRPC != "":
+		agentCheck.GRPC = check.GRPC
+		agentCheck.GRPCUseTLS = check.GRPCUseTLS
+	case check.TTL != "":
+		// TTL check has no interval, it's updated by the service
+		agentCheck.TTL = check.TTL
+		agentCheck.Interval = ""
+		agentCheck.Timeout = ""
+	case check.DockerContainerID != "":
+		agentCheck.DockerContainerID = check.DockerContainerID
+		agentCheck.Shell = check.Shell
+		agentCheck.Args = check.Args
+	case check.AliasService != "":
+		agentCheck.AliasService = check.AliasService
+		agentCheck.AliasNode = check.AliasNode
+		agentCheck.Interval = ""
+		agentCheck.Timeout = ""
+	}
+	return agentCheck
+}
+
+// Coordinates of the nodes of the agent datacenter
+func (d *discovery) Coordinates() (*Coordinate, map[string]*Coordinate, error) {
+	d.nodeNameOnce.Do(func() {
+		d.nodeName, d.nodeNameErr = d.agent.NodeName()
+	})
+	if d.nodeNameErr != nil {
+		return nil, nil, d.nodeNameErr
+	}
+	entries, _, err := d.coordinate.Nodes(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := make(map[string]*Coordinate, len(entries))
+	for _, entry := range entries {
+		if entry.Coord != nil {
+			nodes[entry.Node] = &Coordinate{
+				Vec:        entry.Coord.Vec,
+				Error:      entry.Coord.Error,
+				Adjustment: entry.Coord.Adjustment,
+				Height:     entry.Coord.Height,
+			}
+		}
+	}
+	return nodes[d.nodeName], nodes, nil
+}
+
+// Datacenter of the agent defined by the DSN
+func (d *discovery) Datacenter() string {
+	return d.datacenter
+}
+
 func (d *discovery) Deregister(ident string) error {
 	return d.agent.ServiceDeregister(ident)
 }
 
+// EnableMaintenance of the service registered in the local agent
+func (d *discovery) EnableMaintenance(serviceID, reason string) error {
+	return d.agent.EnableServiceMaintenance(serviceID, reason)
+}
+
+// DisableMaintenance of the service registered in the local agent
+func (d *discovery) DisableMaintenance(serviceID string) error {
+	return d.agent.DisableServiceMaintenance(serviceID)
+}
+
+// UpdateTTL of the check registered in the local agent
+func (d *discovery) UpdateTTL(checkID string, status int8, note string) error {
+	var value string
+	switch status {
+	case SERVICE_STATUS_PASSING:
+		value = api.HealthPassing
+	case SERVICE_STATUS_WARNING:
+		value = api.HealthWarning
+	case SERVICE_STATUS_CRITICAL:
+		value = api.HealthCritical
+	default:
+		return fmt.Errorf("invalid check status %d", status)
+	}
+	return d.agent.UpdateTTL(checkID, note, value)
+}
+
 type sortServiceByID []Service
 
 func (a sortServiceByID) Len() int           { return len(a) }
@@ -84,93 +157,238 @@ func (a sortServiceByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
 //
 // If needed to lookup all services around all DCs,
 // set DC filter to "all". It takes all DCs from discovery
-// and polls services every of them
+// and polls services every of them concurrently. The services of the
+// available DCs are returned together with the *PartialLookupError
+// if some DCs are failed or not responded in the lookup timeout.
+// If all DCs are failed the error wrapping the *PartialLookupError
+// is returned without the services.
 func (d *discovery) Lookup(filter *Filter) ([]Service, error) {
 	if filter == nil {
 		filter = &Filter{}
 	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
 
 	if filter.Datacenter != "all" {
-		return d.lookup(filter)
+		return d.lookup(context.Background(), filter)
 	}
 
-	dcl, err := d.catalog.Datacenters()
+	dcl, err := d.datacenters()
 	if err != nil {
 		return nil, fmt.Errorf("datacenters list: %s", err)
 	}
 
-	var services []Service
-	for _, dc := range dcl {
-		filter.Datacenter = dc
-		s, err := d.lookup(filter)
-		if err != nil {
-			return nil, fmt.Errorf("datacenter %s lookup: %s", dc, err)
-		}
-		services = append(services, s...)
+	type result struct {
+		services []Service
+		err      error
 	}
+	var (
+		wg      sync.WaitGroup
+		results = make([]result, len(dcl))
+	)
+	for i, dc := range dcl {
+		wg.Add(1)
+		go func(res *result, dc string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), d.lookupTimeout)
+			defer cancel()
+			f := *filter
+			f.Datacenter = dc
+			res.services, res.err = d.lookup(ctx, &f)
+		}(&results[i], dc)
+	}
+	wg.Wait()
 
+	var (
+		services []Service
+		failed   = map[string]error{}
+	)
+	for i, res := range results {
+		if res.err != nil {
+			failed[dcl[i]] = res.err
+			continue
+		}
+		services = append(services, res.services...)
+	}
+	if len(failed) != 0 {
+		if len(failed) == len(dcl) {
+			return nil, fmt.Errorf("all datacenters lookup: %w", &PartialLookupError{Errors: failed})
+		}
+		return services, &PartialLookupError{Errors: failed}
+	}
 	return services, nil
 }
 
-func (d *discovery) lookup(filter *Filter) ([]Service, error) {
+// datacenters returns the list of the known DCs sorted by the round trip time,
+// the catalog method has no query options so the request is bounded by the raw query
+func (d *discovery) datacenters() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.lookupTimeout)
+	defer cancel()
+	var dcl []string
+	if _, err := d.raw.Query("/v1/catalog/datacenters", &dcl, (&api.QueryOptions{}).WithContext(ctx)); err != nil {
+		return nil, err
+	}
+	return dcl, nil
+}
+
+func (d *discovery) lookup(ctx context.Context, filter *Filter) ([]Service, error) {
 	var (
 		result []Service
-		q      = &api.QueryOptions{Datacenter: filter.Datacenter}
+		q      = (&api.QueryOptions{Datacenter: filter.Datacenter}).WithContext(ctx)
 	)
+	if len(filter.Service) != 0 {
+		services, _, err := d.lookupService(filter, filter.Status == SERVICE_STATUS_PASSING, q)
+		return services, err
+	}
 	list, _, err := d.catalog.Services(q)
 	if err != nil {
 		return nil, err
 	}
-	var names []string
+	// The checks of all nodes and services of the DC are fetched at once
+	checks, _, err := d.health.State(api.HealthAny, q)
+	if err != nil {
+		return nil, err
+	}
+	// The expression has the selectors of the catalog service endpoint
+	serviceQuery := *q
+	serviceQuery.Filter = filter.Expression
 	for name := range list {
-		names = append(names, name)
-		items, _, err := d.catalog.Service(name, "", q)
+		items, _, err := d.catalog.Service(name, "", &serviceQuery)
 		if err != nil {
 			return nil, err
 		}
 		for _, item := range items {
-			var (
-				srv = Service{
-					ID:         item.ServiceID,
-					Name:       item.ServiceName,
-					Datacenter: item.Datacenter,
-					Address:    item.ServiceAddress,
-					Port:       item.ServicePort,
-					Tags:       item.ServiceTags,
-					Status:     SERVICE_STATUS_UNDEFINED,
-				}
-			)
-			result = append(result, srv)
+			srv := serviceFromCatalog(item)
+			applyChecks(&srv, item.Node, checks)
+			if srv.Match(filter) {
+				result = append(result, srv)
+			}
 		}
 	}
 	sort.Sort(sortServiceByID(result))
-	status := func(status string) int8 {
-		switch status {
-		case "passing":
-			return SERVICE_STATUS_PASSING
-		case "warning":
-			return SERVICE_STATUS_WARNING
-		case "critical":
-			return SERVICE_STATUS_CRITICAL
-		}
-		return SERVICE_STATUS_UNDEFINED
+	return result, nil
+}
+
+// Watch the healthy services by the blocking queries
+//
+// The services of the one DC are watched by the health endpoint of the service.
+// Otherwise every DC is watched by its own blocking queries: of the health endpoint
+// of the service or of the catalog services and the health checks of the DC, the catalog
+// is fetched again only if the services are changed. The services of the failed DCs
+// are kept and retried in the background. The list of the DCs is polled every blockingQueryWaitTime.
+func (d *discovery) Watch(ctx context.Context, filter *Filter) (<-chan []Service, error) {
+	if filter == nil {
+		filter = &Filter{}
+	}
+	f := *filter
+	if len(f.Service) == 0 || f.Datacenter == "all" {
+		return WatchServices(ctx, &f, newCatalogWatch(d, f).fetch)
 	}
-	for _, name := range names {
-		healthChecks, _, err := d.health.Checks(name, q)
+	return WatchServices(ctx, &f, func(ctx context.Context, index uint64) ([]Service, uint64, error) {
+		q := (&api.QueryOptions{Datacenter: f.Datacenter, WaitIndex: index, WaitTime: blockingQueryWaitTime}).WithContext(ctx)
+		services, meta, err := d.lookupService(&f, f.Status == 0 || f.Status == SERVICE_STATUS_PASSING, q)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-		for _, check := range healthChecks {
-			if i := sort.Search(len(result), func(i int) bool { return result[i].ID >= check.ServiceID }); i < len(result) && result[i].ID == check.ServiceID {
-				result[i].Status = status(check.Status)
-			}
+		return services, meta.LastIndex, nil
+	})
+}
+
+// lookupService returns the instances of the one service by the single request
+// of the health endpoint, the required tags without patterns and the expression
+// translated to the health selectors are matched by Consul itself
+func (d *discovery) lookupService(filter *Filter, passingOnly bool, q *api.QueryOptions) ([]Service, *api.QueryMeta, error) {
+	var tags []string
+	for _, tag := range filter.AllTags {
+		if !isTagGlob(tag) {
+			tags = append(tags, tag)
 		}
 	}
-	services := make([]Service, 0, len(result))
-	for _, srv := range result {
-		if srv.test(filter) {
+	if len(filter.Tags) == 1 && !isTagGlob(filter.Tags[0]) {
+		tags = append(tags, filter.Tags[0])
+	}
+	if len(filter.Expression) != 0 {
+		serviceQuery := *q
+		serviceQuery.Filter = healthExpression(filter.Expression)
+		q = &serviceQuery
+	}
+	entries, meta, err := d.health.ServiceMultipleTags(filter.Service, tags, passingOnly, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	services := make([]Service, 0, len(entries))
+	for _, entry := range entries {
+		if srv := serviceFromEntry(entry); srv.Match(filter) {
 			services = append(services, srv)
 		}
 	}
-	return services, nil
+	sort.Sort(sortServiceByID(services))
+	return services, meta, nil
+}
+
+func serviceFromEntry(entry *api.ServiceEntry) Service {
+	srv := Service{
+		ID:         entry.Service.ID,
+		Name:       entry.Service.Service,
+		Datacenter: entry.Node.Datacenter,
+		Node:       entry.Node.Node,
+		Address:    entry.Service.Address,
+		Port:       entry.Service.Port,
+		Tags:       entry.Service.Tags,
+		Meta:       entry.Service.Meta,
+		Status:     SERVICE_STATUS_UNDEFINED,
+	}
+	applyChecks(&srv, entry.Node.Node, entry.Checks)
+	return srv
+}
+
+func serviceFromCatalog(item *api.CatalogService) Service {
+	return Service{
+		ID:         item.ServiceID,
+		Name:       item.ServiceName,
+		Datacenter: item.Datacenter,
+		Node:       item.Node,
+		Address:    item.ServiceAddress,
+		Port:       item.ServicePort,
+		Tags:       item.ServiceTags,
+		Meta:       item.ServiceMeta,
+		Status:     SERVICE_STATUS_UNDEFINED,
+	}
+}
+
+// applyChecks attaches the checks of the service instance and of its node,
+// the status is the worst of them as Consul does
+func applyChecks(srv *Service, node string, checks api.HealthChecks) {
+	for _, check := range checks {
+		if check.Node != node || (len(check.ServiceID) != 0 && check.ServiceID != srv.ID) {
+			continue
+		}
+		status := checkStatus(check.Status)
+		if check.CheckID == api.NodeMaint || strings.HasPrefix(check.CheckID, api.ServiceMaintPrefix) {
+			srv.Maintenance = true
+		}
+		srv.Checks = append(srv.Checks, CheckStatus{
+			ID:        check.CheckID,
+			Name:      check.Name,
+			ServiceID: check.ServiceID,
+			Status:    status,
+			Output:    check.Output,
+		})
+		if status > srv.Status {
+			srv.Status = status
+		}
+	}
+}
+
+func checkStatus(status string) int8 {
+	switch status {
+	case api.HealthPassing:
+		return SERVICE_STATUS_PASSING
+	case api.HealthWarning:
+		return SERVICE_STATUS_WARNING
+	case api.HealthCritical, api.HealthMaint:
+		return SERVICE_STATUS_CRITICAL
+	}
+	return SERVICE_STATUS_UNDEFINED
 }
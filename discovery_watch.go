@@ -0,0 +1,358 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// catalogWatch follows the services of every DC of the filter by the own blocking
+// queries of the DC, so the change of any DC is delivered without waiting for
+// the other ones and the failed DC keeps its last known services
+type catalogWatch struct {
+	d      *discovery
+	filter Filter
+
+	mx       sync.Mutex
+	started  bool
+	version  uint64                        // Index of the merged state
+	dcs      []string                      // DCs in the order of the lookup
+	services map[string][]Service          // DC => the last fetched services
+	stops    map[string]context.CancelFunc // DC => the stop of the DC watcher
+	changed  chan struct{}
+}
+
+func newCatalogWatch(d *discovery, filter Filter) *catalogWatch {
+	return &catalogWatch{
+		d:        d,
+		filter:   filter,
+		services: map[string][]Service{},
+		stops:    map[string]context.CancelFunc{},
+		changed:  make(chan struct{}, 1),
+	}
+}
+
+// fetch implements ServicesFetchFunc, the first call looks up all DCs
+// and starts the watchers, the next ones wait for a change of any DC
+func (w *catalogWatch) fetch(ctx context.Context, index uint64) ([]Service, uint64, error) {
+	w.mx.Lock()
+	started := w.started
+	w.mx.Unlock()
+	if !started {
+		return w.start(ctx)
+	}
+	select {
+	case <-w.changed:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	services, version := w.result()
+	return services, version, nil
+}
+
+func (w *catalogWatch) start(ctx context.Context) ([]Service, uint64, error) {
+	dcl := []string{w.filter.Datacenter}
+	if w.filter.Datacenter == "all" {
+		var err error
+		if dcl, err = w.d.datacenters(); err != nil {
+			return nil, 0, fmt.Errorf("datacenters list: %s", err)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		watchers = make([]*dcWatcher, len(dcl))
+		fetched  = make([][]Service, len(dcl))
+		errs     = make([]error, len(dcl))
+	)
+	for i, dc := range dcl {
+		watchers[i] = newDCWatcher(w.d, w.filter, dc)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fetched[i], errs[i] = watchers[i].next(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := map[string]error{}
+	for i, err := range errs {
+		if err != nil {
+			failed[dcl[i]] = err
+		}
+	}
+	switch {
+	case len(failed) == len(dcl) && w.filter.Datacenter != "all":
+		return nil, 0, errs[0]
+	case len(failed) == len(dcl):
+		return nil, 0, fmt.Errorf("all datacenters lookup: %w", &PartialLookupError{Errors: failed})
+	case len(failed) != 0:
+		// The failed DCs are retried by their watchers
+		log.Printf("registry: watch: %s", &PartialLookupError{Errors: failed})
+	}
+
+	w.mx.Lock()
+	w.started, w.dcs = true, dcl
+	for i, dc := range dcl {
+		w.services[dc] = fetched[i]
+		w.watch(ctx, dc, watchers[i])
+	}
+	w.mx.Unlock()
+	if w.filter.Datacenter == "all" {
+		go w.refreshDatacenters(ctx)
+	}
+	services, version := w.result()
+	return services, version, nil
+}
+
+// watch runs the watcher of the DC until the context is done or the DC is removed, mx must be locked
+func (w *catalogWatch) watch(ctx context.Context, dc string, watcher *dcWatcher) {
+	ctx, w.stops[dc] = context.WithCancel(ctx)
+	go func() {
+		var services []Service
+		for retry(ctx, func() (err error) {
+			if services, err = watcher.next(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("registry: watch datacenter %q: %s", dc, err)
+			}
+			return err
+		}) {
+			w.set(dc, services)
+		}
+	}()
+}
+
+// refreshDatacenters follows the list of the DCs, it has no blocking queries so it's polled
+func (w *catalogWatch) refreshDatacenters(ctx context.Context) {
+	ticker := time.NewTicker(blockingQueryWaitTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		dcl, err := w.d.datacenters()
+		if err != nil {
+			log.Printf("registry: watch: datacenters list: %s", err)
+			continue
+		}
+		w.setDatacenters(ctx, dcl)
+	}
+}
+
+func (w *catalogWatch) setDatacenters(ctx context.Context, dcl []string) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	known := make(map[string]bool, len(dcl))
+	for _, dc := range dcl {
+		known[dc] = true
+		if _, ok := w.stops[dc]; !ok {
+			w.watch(ctx, dc, newDCWatcher(w.d, w.filter, dc))
+		}
+	}
+	for dc, stop := range w.stops {
+		if !known[dc] {
+			stop()
+			delete(w.stops, dc)
+			delete(w.services, dc)
+		}
+	}
+	if !reflect.DeepEqual(w.dcs, dcl) {
+		w.dcs = dcl
+		w.notify()
+	}
+}
+
+func (w *catalogWatch) set(dc string, services []Service) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if _, ok := w.stops[dc]; !ok || reflect.DeepEqual(w.services[dc], services) {
+		return
+	}
+	w.services[dc] = services
+	w.notify()
+}
+
+// notify wakes up the waiting fetch, mx must be locked
+func (w *catalogWatch) notify() {
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// result returns the services of all DCs in the order of the lookup
+func (w *catalogWatch) result() ([]Service, uint64) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	var result []Service
+	for _, dc := range w.dcs {
+		result = append(result, w.services[dc]...)
+	}
+	w.version++
+	return result, w.version
+}
+
+// dcWatcher follows the services of the one DC. The instances of the one service are
+// watched by the health endpoint of the service. All services are watched by the indexes
+// of the catalog and of the health checks, so the change of a check doesn't fetch the catalog again.
+type dcWatcher struct {
+	d       *discovery
+	filter  Filter
+	timeout time.Duration // Bound of the non-blocking queries in the watch of all DCs
+
+	index         uint64 // Index of the health endpoint of the service
+	servicesIndex uint64 // Index of the catalog services
+	checksIndex   uint64 // Index of the health checks
+	checks        api.HealthChecks
+	items         map[string][]*api.CatalogService // Service name => the instances
+}
+
+func newDCWatcher(d *discovery, filter Filter, dc string) *dcWatcher {
+	w := &dcWatcher{d: d, filter: filter}
+	if filter.Datacenter == "all" {
+		// The failed DC doesn't hold the start of the watch of the other ones
+		w.timeout = d.lookupTimeout
+	}
+	w.filter.Datacenter = dc
+	return w
+}
+
+// next returns the services of the DC, it blocks until the state of the DC
+// is changed or the wait time is over unless it's the first call
+func (w *dcWatcher) next(ctx context.Context) ([]Service, error) {
+	if len(w.filter.Service) != 0 {
+		q, cancel := w.query(ctx, w.index)
+		defer cancel()
+		services, meta, err := w.d.lookupService(&w.filter, w.filter.Status == 0 || w.filter.Status == SERVICE_STATUS_PASSING, q)
+		if err != nil {
+			return nil, err
+		}
+		w.index = nextIndex(w.index, meta.LastIndex)
+		return services, nil
+	}
+	if w.servicesIndex == 0 || w.checksIndex == 0 {
+		q, cancel := w.query(ctx, 0)
+		defer cancel()
+		list, servicesMeta, err := w.d.catalog.Services(q)
+		if err != nil {
+			return nil, err
+		}
+		checks, checksMeta, err := w.d.health.State(api.HealthAny, q)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.fetchItems(ctx, list); err != nil {
+			return nil, err
+		}
+		w.servicesIndex, w.checksIndex, w.checks = servicesMeta.LastIndex, checksMeta.LastIndex, checks
+		return w.services(), nil
+	}
+
+	type result struct {
+		list   map[string][]string
+		checks api.HealthChecks
+		meta   *api.QueryMeta
+		err    error
+	}
+	var (
+		servicesResult = make(chan result, 1)
+		checksResult   = make(chan result, 1)
+	)
+	servicesQuery, cancel := w.query(ctx, w.servicesIndex)
+	defer cancel()
+	checksQuery := *servicesQuery
+	checksQuery.WaitIndex = w.checksIndex
+	go func() {
+		list, meta, err := w.d.catalog.Services(servicesQuery)
+		servicesResult <- result{list: list, meta: meta, err: err}
+	}()
+	go func() {
+		checks, meta, err := w.d.health.State(api.HealthAny, &checksQuery)
+		checksResult <- result{checks: checks, meta: meta, err: err}
+	}()
+
+	// The first answered query cancels the other one, its result is used if it's in time
+	var services, checks result
+	select {
+	case services = <-servicesResult:
+		cancel()
+		checks = <-checksResult
+		if services.err != nil {
+			return nil, services.err
+		}
+	case checks = <-checksResult:
+		cancel()
+		services = <-servicesResult
+		if checks.err != nil {
+			return nil, checks.err
+		}
+	}
+	if checks.err == nil {
+		w.checksIndex, w.checks = nextIndex(w.checksIndex, checks.meta.LastIndex), checks.checks
+	}
+	if services.err == nil && services.meta.LastIndex != w.servicesIndex {
+		if err := w.fetchItems(ctx, services.list); err != nil {
+			return nil, err
+		}
+		w.servicesIndex = nextIndex(w.servicesIndex, services.meta.LastIndex)
+	}
+	return w.services(), nil
+}
+
+// query returns the options of the blocking query with the index,
+// the query without the index is bounded by the timeout if it's defined
+func (w *dcWatcher) query(ctx context.Context, index uint64) (*api.QueryOptions, context.CancelFunc) {
+	q := &api.QueryOptions{Datacenter: w.filter.Datacenter}
+	if index == 0 && w.timeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, w.timeout)
+		return q.WithContext(ctx), cancel
+	}
+	if index == 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return q.WithContext(ctx), cancel
+	}
+	q.WaitIndex, q.WaitTime = index, blockingQueryWaitTime
+	ctx, cancel := context.WithCancel(ctx)
+	return q.WithContext(ctx), cancel
+}
+
+// fetchItems fetches the instances of the listed services
+func (w *dcWatcher) fetchItems(ctx context.Context, list map[string][]string) error {
+	q, cancel := w.query(ctx, 0)
+	defer cancel()
+	// The expression has the selectors of the catalog service endpoint
+	q.Filter = w.filter.Expression
+	items := make(map[string][]*api.CatalogService, len(list))
+	for name := range list {
+		serviceItems, _, err := w.d.catalog.Service(name, "", q)
+		if err != nil {
+			return err
+		}
+		items[name] = serviceItems
+	}
+	w.items = items
+	return nil
+}
+
+// services returns the matched services with the last known checks
+func (w *dcWatcher) services() []Service {
+	var result []Service
+	for _, items := range w.items {
+		for _, item := range items {
+			srv := serviceFromCatalog(item)
+			applyChecks(&srv, item.Node, w.checks)
+			if srv.Match(&w.filter) {
+				result = append(result, srv)
+			}
+		}
+	}
+	sort.Sort(sortServiceByID(result))
+	return result
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// Driver creates the KV storage and the service discovery of the backend
+// from the parsed DSN. The scheme of the DSN selects the driver.
+type Driver func(dsn *url.URL) (KV, Discovery, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Driver{}
+)
+
+// RegisterDriver makes the registry backend available by the DSN scheme.
+// If RegisterDriver is called twice with the same scheme or if driver is nil, it panics.
+func RegisterDriver(scheme string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if driver == nil {
+		panic("registry: RegisterDriver driver is nil")
+	}
+	if _, dup := drivers[scheme]; dup {
+		panic("registry: RegisterDriver called twice for scheme " + scheme)
+	}
+	drivers[scheme] = driver
+}
+
+// Drivers returns a sorted list of the schemes of the registered drivers
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	list := make([]string, 0, len(drivers))
+	for scheme := range drivers {
+		list = append(list, scheme)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func driver(scheme string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	driver, ok := drivers[scheme]
+	if !ok {
+		return nil, fmt.Errorf("registry: unknown driver %q (forgotten import?)", scheme)
+	}
+	return driver, nil
+}
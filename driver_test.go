@@ -0,0 +1,40 @@
+package registry
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Driver(t *testing.T) {
+	var (
+		errDriver = errors.New("driver error")
+		dsn       *url.URL
+	)
+	RegisterDriver("test", func(u *url.URL) (KV, Discovery, error) {
+		dsn = u
+		return nil, nil, errDriver
+	})
+	defer func() {
+		driversMu.Lock()
+		delete(drivers, "test")
+		driversMu.Unlock()
+	}()
+
+	assert.Contains(t, Drivers(), "test")
+	assert.Contains(t, Drivers(), "consul")
+
+	_, err := New("test://host:1234?dc=dc1", nil)
+	if assert.Equal(t, errDriver, err) && assert.NotNil(t, dsn) {
+		assert.Equal(t, "host:1234", dsn.Host)
+		assert.Equal(t, "dc1", dsn.Query().Get("dc"))
+	}
+
+	assert.Panics(t, func() { RegisterDriver("test", newConsulBackend) })
+	assert.Panics(t, func() { RegisterDriver("nil", nil) })
+
+	_, err = New("unknown://host", nil)
+	assert.EqualError(t, err, `registry: unknown driver "unknown" (forgotten import?)`)
+}
@@ -0,0 +1,452 @@
+// Package etcd implements the registry backend which keeps the KV storage
+// and the service catalogue in the etcd cluster.
+//
+// The backend is selected by the etcd:// DSN scheme:
+//
+//	import _ "github.com/trafficstars/registry/etcd"
+//
+//	r, _ := registry.New("etcd://127.0.0.1:2379,127.0.0.2:2379?dc=dc1", os.Args)
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/trafficstars/registry"
+)
+
+const (
+	// servicesPrefix is the key prefix of the registered services
+	servicesPrefix = "services"
+
+	// defaultTTL of the service lease if the check TTL is not defined
+	defaultTTL = 10 * time.Second
+
+	requestTimeout = 5 * time.Second
+
+	// Backoff of the registration of the service which lease is lost
+	registerMinRetryInterval = time.Second
+	registerMaxRetryInterval = time.Minute
+)
+
+// errWatchClosed is returned if the watch is closed by the client, not by the context
+var errWatchClosed = errors.New("etcd: watch closed")
+
+func init() {
+	registry.RegisterDriver("etcd", newBackend)
+}
+
+// newBackend connects to the etcd cluster defined as
+// etcd://[user:password@]host1:2379,host2:2379?dc=dc1
+func newBackend(url *url.URL) (registry.KV, registry.Discovery, error) {
+	config := clientv3.Config{
+		Endpoints:   strings.Split(url.Host, ","),
+		DialTimeout: requestTimeout,
+	}
+	if url.User != nil {
+		config.Username = url.User.Username()
+		config.Password, _ = url.User.Password()
+	}
+	client, err := clientv3.New(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &kv{client: client}, &discovery{
+		client:        client,
+		datacenter:    url.Query().Get("dc"),
+		registrations: map[string]*registration{},
+	}, nil
+}
+
+type kv struct {
+	client *clientv3.Client
+}
+
+func (kv *kv) Get(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := kv.client.Get(ctx, registry.RegistryPrefix+"/"+key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) != 0 {
+		return string(resp.Kvs[0].Value), nil
+	}
+	return "", nil
+}
+
+func (kv *kv) Set(key, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := kv.client.Put(ctx, registry.RegistryPrefix+"/"+key, value)
+	return err
+}
+
+func (kv *kv) List(prefix string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := kv.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]string, len(resp.Kvs))
+	for _, k := range resp.Kvs {
+		list[string(k.Key)] = string(k.Value)
+	}
+	return list, nil
+}
+
+func (kv *kv) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := kv.client.Delete(ctx, registry.RegistryPrefix+"/"+key)
+	return err
+}
+
+func (kv *kv) Watch(ctx context.Context, key string) (<-chan registry.KVEvent, error) {
+	return registry.WatchKV(ctx, kv.fetch(registry.RegistryPrefix+"/"+key))
+}
+
+func (kv *kv) WatchPrefix(ctx context.Context, prefix string) (<-chan registry.KVEvent, error) {
+	return registry.WatchKV(ctx, kv.fetch(prefix, clientv3.WithPrefix()))
+}
+
+// fetch the keys after the next change since the revision
+func (kv *kv) fetch(key string, opts ...clientv3.OpOption) registry.KVFetchFunc {
+	return func(ctx context.Context, index uint64) (map[string]registry.KVEntry, uint64, error) {
+		if index != 0 {
+			watchCtx, cancel := context.WithCancel(ctx)
+			resp, ok := <-kv.client.Watch(watchCtx, key, append(opts, clientv3.WithRev(int64(index)+1))...)
+			cancel()
+			if !ok {
+				return nil, 0, watchClosed(ctx)
+			}
+			// The compacted revision just requires to fetch the whole state again
+			if err := resp.Err(); err != nil && resp.CompactRevision == 0 {
+				return nil, 0, err
+			}
+		}
+		resp, err := kv.client.Get(ctx, key, opts...)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries := make(map[string]registry.KVEntry, len(resp.Kvs))
+		for _, k := range resp.Kvs {
+			entries[string(k.Key)] = registry.KVEntry{Value: string(k.Value), ModifyIndex: uint64(k.ModRevision)}
+		}
+		return entries, uint64(resp.Header.Revision), nil
+	}
+}
+
+// watchClosed returns the error of the closed watch channel, the nil error
+// would be taken as the empty state and turned into the deletion of all keys
+func watchClosed(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errWatchClosed
+}
+
+// registration keeps the lease of the service registered by this process,
+// the service is registered again by the new lease if the lease is expired
+type registration struct {
+	key    string
+	value  string           // Guarded by the mx of the discovery
+	ttl    int64            // Seconds
+	lease  clientv3.LeaseID // Guarded by the mx of the discovery
+	cancel context.CancelFunc
+}
+
+// discovery stores every service instance as JSON under the
+// services/<name>/<id> key attached to the lease which is kept alive
+// while the process is running. The instance disappears as soon as the
+// lease expires, so every found service is considered as passing
+// unless it's in maintenance.
+type discovery struct {
+	mx            sync.Mutex
+	client        *clientv3.Client
+	datacenter    string
+	registrations map[string]*registration
+}
+
+func (d *discovery) Register(options registry.ServiceOptions) error {
+	host, port, err := registry.SplitServiceAddress(options.Address)
+	if err != nil {
+		return err
+	}
+	ttl := defaultTTL
+	for _, check := range options.HealthChecks() {
+		if check.TTL != "" {
+			if ttl, err = time.ParseDuration(check.TTL); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	value, err := json.Marshal(registry.Service{
+		ID:         options.ID,
+		Name:       options.Name,
+		Datacenter: d.datacenter,
+		Address:    host,
+		Port:       port,
+		Tags:       append(options.Tags, "DC="+d.datacenter),
+		Meta:       options.Meta,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The lease of the previous registration is revoked, so its key is removed
+	d.release(options.ID)
+
+	instance := &registration{
+		key:   path.Join(servicesPrefix, options.Name, options.ID),
+		value: string(value),
+		ttl:   int64((ttl + time.Second - 1) / time.Second),
+	}
+	if instance.lease, err = d.put(context.Background(), instance); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	keepAlive, err := d.client.KeepAlive(ctx, instance.lease)
+	if err != nil {
+		cancel()
+		return err
+	}
+	instance.cancel = cancel
+
+	d.mx.Lock()
+	d.registrations[options.ID] = instance
+	d.mx.Unlock()
+	go d.keepAlive(ctx, instance, keepAlive)
+	return nil
+}
+
+// put the service by the new lease
+func (d *discovery) put(ctx context.Context, instance *registration) (clientv3.LeaseID, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	lease, err := d.client.Grant(ctx, instance.ttl)
+	if err != nil {
+		return 0, err
+	}
+	d.mx.Lock()
+	value := instance.value
+	d.mx.Unlock()
+	if _, err = d.client.Put(ctx, instance.key, value, clientv3.WithLease(lease.ID)); err != nil {
+		return 0, err
+	}
+	return lease.ID, nil
+}
+
+// keepAlive keeps the lease of the service until the registration is released.
+// The keepalive channel is closed if the lease is expired (etcd was unreachable
+// longer than the TTL), then the service is registered again with the backoff.
+func (d *discovery) keepAlive(ctx context.Context, instance *registration, keepAlive <-chan *clientv3.LeaseKeepAliveResponse) {
+	for {
+		for range keepAlive {
+		}
+		for backoff := registerMinRetryInterval; ; {
+			if ctx.Err() != nil {
+				return
+			}
+			lease, err := d.put(ctx, instance)
+			if err == nil {
+				d.mx.Lock()
+				instance.lease = lease
+				d.mx.Unlock()
+				if ctx.Err() != nil {
+					// The registration is released while the lease was granted
+					d.revoke(lease)
+					return
+				}
+				if keepAlive, err = d.client.KeepAlive(ctx, lease); err == nil {
+					break
+				}
+			}
+			if ctx.Err() == nil {
+				log.Printf("etcd: register %s: %s", instance.key, err)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > registerMaxRetryInterval {
+				backoff = registerMaxRetryInterval
+			}
+		}
+	}
+}
+
+// Datacenter stored with every service registered by this process
+func (d *discovery) Datacenter() string {
+	return d.datacenter
+}
+
+func (d *discovery) Deregister(ident string) error {
+	if d.release(ident) {
+		return nil
+	}
+
+	// The service was registered by another process
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := d.client.Get(ctx, servicesPrefix+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	for _, k := range resp.Kvs {
+		if path.Base(string(k.Key)) == ident {
+			if _, err := d.client.Delete(ctx, string(k.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EnableMaintenance of the service, the flag is stored together with the instance
+func (d *discovery) EnableMaintenance(serviceID, reason string) error {
+	return d.setMaintenance(serviceID, true)
+}
+
+// DisableMaintenance of the service
+func (d *discovery) DisableMaintenance(serviceID string) error {
+	return d.setMaintenance(serviceID, false)
+}
+
+func (d *discovery) setMaintenance(ident string, maintenance bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := d.client.Get(ctx, servicesPrefix+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, k := range resp.Kvs {
+		if path.Base(string(k.Key)) != ident {
+			continue
+		}
+		var srv registry.Service
+		if err := json.Unmarshal(k.Value, &srv); err != nil {
+			return err
+		}
+		srv.Maintenance = maintenance
+		value, err := json.Marshal(srv)
+		if err != nil {
+			return err
+		}
+		// The instance keeps the lease of the registration
+		if _, err := d.client.Put(ctx, string(k.Key), string(value), clientv3.WithIgnoreLease()); err != nil {
+			return err
+		}
+		d.mx.Lock()
+		if instance, ok := d.registrations[ident]; ok && instance.key == string(k.Key) {
+			// The flag is kept if the service is registered again
+			instance.value = string(value)
+		}
+		d.mx.Unlock()
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("unknown service %q", ident)
+	}
+	return nil
+}
+
+// release stops the keepalive and revokes the lease of the service
+// registered by this process
+func (d *discovery) release(ident string) bool {
+	d.mx.Lock()
+	instance, ok := d.registrations[ident]
+	delete(d.registrations, ident)
+	d.mx.Unlock()
+	if !ok {
+		return false
+	}
+	instance.cancel()
+	d.mx.Lock()
+	lease := instance.lease
+	d.mx.Unlock()
+	d.revoke(lease)
+	return true
+}
+
+func (d *discovery) revoke(lease clientv3.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	d.client.Revoke(ctx, lease)
+}
+
+// Lookup services by filter
+func (d *discovery) Lookup(filter *registry.Filter) ([]registry.Service, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	services, _, err := d.lookup(ctx, filter)
+	return services, err
+}
+
+// Watch the services by the etcd watch of the services prefix
+func (d *discovery) Watch(ctx context.Context, filter *registry.Filter) (<-chan []registry.Service, error) {
+	return registry.WatchServices(ctx, filter, func(ctx context.Context, index uint64) ([]registry.Service, uint64, error) {
+		if index != 0 {
+			watchCtx, cancel := context.WithCancel(ctx)
+			resp, ok := <-d.client.Watch(watchCtx, servicesPrefix+"/", clientv3.WithPrefix(), clientv3.WithRev(int64(index)+1))
+			cancel()
+			if !ok {
+				return nil, 0, watchClosed(ctx)
+			}
+			if err := resp.Err(); err != nil && resp.CompactRevision == 0 {
+				return nil, 0, err
+			}
+		}
+		services, revision, err := d.lookup(ctx, filter)
+		return services, uint64(revision), err
+	})
+}
+
+// lookup returns the services and the revision of the cluster state
+func (d *discovery) lookup(ctx context.Context, filter *registry.Filter) ([]registry.Service, int64, error) {
+	filter = filter.WithoutAllDatacenter()
+
+	prefix := servicesPrefix + "/"
+	if len(filter.Service) != 0 {
+		prefix += filter.Service + "/"
+	}
+
+	resp, err := d.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	services := make([]registry.Service, 0, len(resp.Kvs))
+	for _, k := range resp.Kvs {
+		var srv registry.Service
+		if err := json.Unmarshal(k.Value, &srv); err != nil {
+			continue
+		}
+		if srv.Status = registry.SERVICE_STATUS_PASSING; srv.Maintenance {
+			srv.Status = registry.SERVICE_STATUS_CRITICAL
+		}
+		if srv.Match(filter) {
+			services = append(services, srv)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, resp.Header.Revision, nil
+}
@@ -0,0 +1,197 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"github.com/trafficstars/registry"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func nextEvent(t *testing.T, events <-chan registry.KVEvent) registry.KVEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return registry.KVEvent{}
+}
+
+func runEmbedEtcd(t *testing.T) string {
+	var (
+		cfg        = embed.NewConfig()
+		clientURL  = url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", freePort(t))}
+		peerURL    = url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", freePort(t))}
+		listenURLs = []url.URL{clientURL}
+	)
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = listenURLs, listenURLs
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peerURL}, []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd server is not ready")
+	}
+	return clientURL.Host
+}
+
+func Test_Etcd(t *testing.T) {
+	address := runEmbedEtcd(t)
+	r, err := registry.New("etcd://"+address+"?dc=dc1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Run("kv", func(t *testing.T) {
+		kv := r.KV()
+		if assert.NoError(t, kv.Set("service/name", "test")) {
+			v, err := kv.Get("service/name")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "test", v)
+			}
+		}
+		list, err := kv.List(registry.RegistryPrefix + "/service/")
+		if assert.NoError(t, err) {
+			assert.Equal(t, map[string]string{registry.RegistryPrefix + "/service/name": "test"}, list)
+		}
+		if assert.NoError(t, kv.Delete("service/name")) {
+			v, err := kv.Get("service/name")
+			if assert.NoError(t, err) {
+				assert.Equal(t, "", v)
+			}
+		}
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		kv := r.KV()
+		events, err := kv.WatchPrefix(ctx, registry.RegistryPrefix+"/watch/")
+		if !assert.NoError(t, err) {
+			return
+		}
+		kv.Set("watch/key", "1")
+		event := nextEvent(t, events)
+		assert.Equal(t, registry.KV_EVENT_PUT, event.Type)
+		assert.Equal(t, registry.RegistryPrefix+"/watch/key", event.Key)
+		assert.Equal(t, "1", event.Value)
+
+		kv.Delete("watch/key")
+		event = nextEvent(t, events)
+		assert.Equal(t, registry.KV_EVENT_DELETE, event.Type)
+		assert.Equal(t, registry.RegistryPrefix+"/watch/key", event.Key)
+	})
+
+	t.Run("watch closed", func(t *testing.T) {
+		store, _, err := newBackend(&url.URL{Scheme: "etcd", Host: address})
+		if !assert.NoError(t, err) {
+			return
+		}
+		fetch := store.(*kv).fetch(registry.RegistryPrefix+"/closed/", clientv3.WithPrefix())
+		_, index, err := fetch(context.Background(), 0)
+		if !assert.NoError(t, err) {
+			return
+		}
+		time.AfterFunc(100*time.Millisecond, func() { store.(*kv).client.Close() })
+		// The closed watch is the error, not the empty state of the keys
+		_, _, err = fetch(context.Background(), index)
+		assert.Equal(t, errWatchClosed, err)
+	})
+
+	t.Run("discovery", func(t *testing.T) {
+		d := r.Discovery()
+		for _, id := range []string{"api-1", "api-2"} {
+			err := d.Register(registry.ServiceOptions{
+				ID:      id,
+				Name:    "api",
+				Address: "http://127.0.0.1:8080",
+				Tags:    []string{"test"},
+			})
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, d.Register(registry.ServiceOptions{ID: "db-1", Name: "db", Address: "127.0.0.2:5432"}))
+
+		services, err := d.Lookup(&registry.Filter{Service: "api", Tags: []string{"test"}})
+		if assert.NoError(t, err) && assert.Len(t, services, 2) {
+			assert.Equal(t, "api-1", services[0].ID)
+			assert.Equal(t, "dc1", services[0].Datacenter)
+			assert.Equal(t, "127.0.0.1", services[0].Address)
+			assert.Equal(t, 8080, services[0].Port)
+			assert.Equal(t, registry.SERVICE_STATUS_PASSING, services[0].Status)
+		}
+
+		services, err = d.Lookup(&registry.Filter{Datacenter: "all"})
+		if assert.NoError(t, err) {
+			assert.Len(t, services, 3)
+		}
+
+		t.Run("expired lease", func(t *testing.T) {
+			backend := d.(*discovery)
+			backend.mx.Lock()
+			lease := backend.registrations["db-1"].lease
+			backend.mx.Unlock()
+			backend.revoke(lease)
+
+			services, err := d.Lookup(&registry.Filter{Service: "db"})
+			if assert.NoError(t, err) {
+				assert.Len(t, services, 0, "the service is removed together with the lease")
+			}
+			assert.Eventually(t, func() bool {
+				services, err := d.Lookup(&registry.Filter{Service: "db"})
+				return err == nil && len(services) == 1
+			}, 15*time.Second, 100*time.Millisecond, "the service is registered again by the new lease")
+		})
+
+		if assert.NoError(t, d.Deregister("api-1")) {
+			services, err = d.Lookup(&registry.Filter{Service: "api"})
+			if assert.NoError(t, err) && assert.Len(t, services, 1) {
+				assert.Equal(t, "api-2", services[0].ID)
+			}
+		}
+	})
+
+	t.Run("maintenance", func(t *testing.T) {
+		d := r.Discovery()
+		assert.NoError(t, d.Register(registry.ServiceOptions{ID: "web-1", Name: "web", Address: "127.0.0.1:80"}))
+		assert.Error(t, d.EnableMaintenance("unknown", "test"))
+		if assert.NoError(t, d.EnableMaintenance("web-1", "test")) {
+			services, err := d.Lookup(&registry.Filter{Service: "web"})
+			if assert.NoError(t, err) && assert.Len(t, services, 1) {
+				assert.True(t, services[0].Maintenance)
+				assert.Equal(t, registry.SERVICE_STATUS_CRITICAL, services[0].Status)
+			}
+		}
+		if assert.NoError(t, d.DisableMaintenance("web-1")) {
+			services, err := d.Lookup(&registry.Filter{Service: "web", Status: registry.SERVICE_STATUS_PASSING})
+			if assert.NoError(t, err) {
+				assert.Len(t, services, 1)
+			}
+		}
+	})
+}
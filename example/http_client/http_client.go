@@ -33,7 +33,8 @@ func main() {
 			ID:      "serviceID",
 			Name:    "example-service",
 			Address: "127.0.0.1:8888",
-			Tags:    []string{"A", "B", "C", "SERVICE_WEIGHT=3"},
+			Tags:    []string{"A", "B", "C"},
+			Meta:    map[string]string{"SERVICE_WEIGHT": "3"},
 			Check: registry.CheckOptions{
 				Interval: "5s",
 				Timeout:  "2s",
@@ -48,7 +49,8 @@ func main() {
 			ID:      "serviceID2",
 			Name:    "example-service",
 			Address: "127.0.0.1:8889",
-			Tags:    []string{"A", "B", "C", "SERVICE_WEIGHT=10"},
+			Tags:    []string{"A", "B", "C"},
+			Meta:    map[string]string{"SERVICE_WEIGHT": "10"},
 			Check: registry.CheckOptions{
 				Interval: "5s",
 				Timeout:  "2s",
@@ -63,7 +65,8 @@ func main() {
 			ID:      "serviceID3",
 			Name:    "example-service",
 			Address: "127.0.0.1:8899",
-			Tags:    []string{"A", "B", "C", "SERVICE_WEIGHT=7"},
+			Tags:    []string{"A", "B", "C"},
+			Meta:    map[string]string{"SERVICE_WEIGHT": "7"},
 			Check: registry.CheckOptions{
 				Interval: "5s",
 				Timeout:  "2s",
@@ -0,0 +1,146 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-bexpr"
+)
+
+// expressionCacheSize limits the number of the compiled filter expressions,
+// the cache is dropped when it's full since the expressions are defined by the users
+const expressionCacheSize = 1024
+
+// expressionCache keeps the compiled filter expressions
+var expressionCache = struct {
+	sync.Mutex
+	evaluators map[string]*bexpr.Evaluator
+}{evaluators: map[string]*bexpr.Evaluator{}}
+
+// expressionService is the view of the service for the filter expression,
+// the selectors are the same as in the Consul catalog service endpoint
+type expressionService struct {
+	ServiceID      string
+	ServiceName    string
+	ServiceAddress string
+	ServicePort    int
+	ServiceTags    []string
+	ServiceMeta    map[string]string
+	Datacenter     string
+	Node           string
+}
+
+// healthSelectors maps the selectors of the catalog service endpoint
+// to the selectors of the health service endpoint
+var healthSelectors = map[string]string{
+	"ServiceID":      "Service.ID",
+	"ServiceName":    "Service.Service",
+	"ServiceAddress": "Service.Address",
+	"ServicePort":    "Service.Port",
+	"ServiceTags":    "Service.Tags",
+	"ServiceMeta":    "Service.Meta",
+	"Datacenter":     "Node.Datacenter",
+	"Node":           "Node.Node",
+}
+
+// healthExpression translates the expression to the selectors of the health service endpoint,
+// the string literals and the nested fields of the selectors are kept as is
+func healthExpression(expression string) string {
+	var (
+		result strings.Builder
+		prev   byte // Previous significant character
+	)
+	for i := 0; i < len(expression); {
+		switch c := expression[i]; {
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(expression) && expression[end] != c {
+				if c == '"' && expression[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(expression) {
+				end++
+			}
+			result.WriteString(expression[i:end])
+			i, prev = end, c
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := i + 1
+			for end < len(expression) && (expression[end] == '_' || expression[end] >= 'a' && expression[end] <= 'z' ||
+				expression[end] >= 'A' && expression[end] <= 'Z' || expression[end] >= '0' && expression[end] <= '9') {
+				end++
+			}
+			ident := expression[i:end]
+			if selector, ok := healthSelectors[ident]; ok && prev != '.' {
+				ident = selector
+			}
+			result.WriteString(ident)
+			i, prev = end, 'a'
+		default:
+			result.WriteByte(c)
+			if c != ' ' && c != '\t' && c != '\n' {
+				prev = c
+			}
+			i++
+		}
+	}
+	return result.String()
+}
+
+// evaluator returns the compiled filter expression
+func evaluator(expression string) (*bexpr.Evaluator, error) {
+	expressionCache.Lock()
+	eval, ok := expressionCache.evaluators[expression]
+	expressionCache.Unlock()
+	if ok {
+		return eval, nil
+	}
+	eval, err := bexpr.CreateEvaluator(expression)
+	if err != nil {
+		return nil, err
+	}
+	// The selectors which are unknown to the expressionService (like NodeMeta of Consul)
+	// pass the syntax check but fail the evaluation, so they would match nothing
+	if _, err := eval.Evaluate(expressionService{}); err != nil {
+		return nil, fmt.Errorf("unsupported filter expression: %w", err)
+	}
+	expressionCache.Lock()
+	if len(expressionCache.evaluators) >= expressionCacheSize {
+		expressionCache.evaluators = map[string]*bexpr.Evaluator{}
+	}
+	expressionCache.evaluators[expression] = eval
+	expressionCache.Unlock()
+	return eval, nil
+}
+
+// matchExpression returns true if the service satisfies the expression,
+// the invalid expression matches nothing
+func (s *Service) matchExpression(expression string) bool {
+	eval, err := evaluator(expression)
+	if err != nil {
+		return false
+	}
+	ok, err := eval.Evaluate(expressionService{
+		ServiceID:      s.ID,
+		ServiceName:    s.Name,
+		ServiceAddress: s.Address,
+		ServicePort:    s.Port,
+		ServiceTags:    s.Tags,
+		ServiceMeta:    s.Meta,
+		Datacenter:     s.Datacenter,
+		Node:           s.Node,
+	})
+	return err == nil && ok
+}
+
+// Validate returns the error if the filter expression is invalid
+// or it has the selectors which are not listed in the Filter.Expression
+func (f *Filter) Validate() error {
+	if f == nil || len(f.Expression) == 0 {
+		return nil
+	}
+	_, err := evaluator(f.Expression)
+	return err
+}
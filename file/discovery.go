@@ -0,0 +1,151 @@
+package file
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/trafficstars/registry"
+	"github.com/trafficstars/registry/memory"
+)
+
+// discovery merges the static catalogue of the file with the services
+// registered by the process. Nobody checks the health of the registered
+// services, so they are always passing.
+type discovery struct {
+	source       *source
+	overlay      *memory.Discovery
+	mx           sync.RWMutex
+	deregistered map[string]bool
+	maintenance  map[string]bool // Static services in maintenance
+}
+
+func newDiscovery(src *source) *discovery {
+	return &discovery{
+		source:       src,
+		overlay:      memory.NewDiscovery(src.datacenter),
+		deregistered: map[string]bool{},
+		maintenance:  map[string]bool{},
+	}
+}
+
+func (d *discovery) Register(options registry.ServiceOptions) error {
+	if err := d.overlay.Register(options); err != nil {
+		return err
+	}
+	d.mx.Lock()
+	delete(d.deregistered, options.ID)
+	d.mx.Unlock()
+	defer d.source.notify()
+	return d.overlay.Pass(options.ID)
+}
+
+// Datacenter defined by the dc parameter of the DSN, the static services without
+// the datacenter in the file belong to it
+func (d *discovery) Datacenter() string {
+	return d.source.datacenter
+}
+
+func (d *discovery) Deregister(ident string) error {
+	d.mx.Lock()
+	d.deregistered[ident] = true
+	d.mx.Unlock()
+	defer d.source.notify()
+	return d.overlay.Deregister(ident)
+}
+
+// Close stops the polling of the file
+func (d *discovery) Close() error {
+	return d.source.Close()
+}
+
+// EnableMaintenance of the registered or static service instance
+func (d *discovery) EnableMaintenance(serviceID, reason string) error {
+	return d.setMaintenance(serviceID, true)
+}
+
+// DisableMaintenance of the registered or static service instance
+func (d *discovery) DisableMaintenance(serviceID string) error {
+	return d.setMaintenance(serviceID, false)
+}
+
+func (d *discovery) setMaintenance(ident string, maintenance bool) error {
+	defer d.source.notify()
+	if registered, _ := d.overlay.Lookup(&registry.Filter{ID: ident, Datacenter: "all"}); len(registered) != 0 {
+		if maintenance {
+			return d.overlay.EnableMaintenance(ident, "")
+		}
+		return d.overlay.DisableMaintenance(ident)
+	}
+	if static, _ := d.Lookup(&registry.Filter{ID: ident, Datacenter: "all"}); len(static) == 0 {
+		return fmt.Errorf("unknown service %q", ident)
+	}
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if maintenance {
+		d.maintenance[ident] = true
+	} else {
+		delete(d.maintenance, ident)
+	}
+	return nil
+}
+
+// Lookup services by filter
+func (d *discovery) Lookup(filter *registry.Filter) ([]registry.Service, error) {
+	services, err := d.overlay.Lookup(filter)
+	if err != nil {
+		return nil, err
+	}
+	filter = filter.WithoutAllDatacenter()
+
+	// The registered instances override the static ones with the same ID
+	all, _ := d.overlay.Lookup(&registry.Filter{Datacenter: "all"})
+	registered := make(map[string]bool, len(all))
+	for _, srv := range all {
+		registered[srv.ID] = true
+	}
+
+	d.source.mx.RLock()
+	d.mx.RLock()
+	for _, srv := range d.source.services {
+		if d.maintenance[srv.ID] {
+			srv.Maintenance = true
+			srv.Status = registry.SERVICE_STATUS_CRITICAL
+		}
+		if registered[srv.ID] || d.deregistered[srv.ID] || !srv.Match(filter) {
+			continue
+		}
+		srv.Tags = append([]string{}, srv.Tags...)
+		srv.Meta = copyMeta(srv.Meta)
+		services = append(services, srv)
+	}
+	d.mx.RUnlock()
+	d.source.mx.RUnlock()
+
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, nil
+}
+
+// Watch the services after every change of the file or of the registered services
+func (d *discovery) Watch(ctx context.Context, filter *registry.Filter) (<-chan []registry.Service, error) {
+	return registry.WatchServices(ctx, filter, func(ctx context.Context, index uint64) ([]registry.Service, uint64, error) {
+		version, err := d.source.next(ctx, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		services, err := d.Lookup(filter)
+		return services, version, err
+	})
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	c := make(map[string]string, len(meta))
+	for key, value := range meta {
+		c[key] = value
+	}
+	return c
+}
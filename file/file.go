@@ -0,0 +1,248 @@
+// Package file implements the registry backend for the local development
+// which reads the KV tree and the static service catalogue from YAML or JSON file.
+//
+// The backend is selected by the file:// DSN scheme:
+//
+//	import _ "github.com/trafficstars/registry/file"
+//
+//	r, _ := registry.New("file:///path/to/registry.yaml?dc=dc1&poll_interval=1", os.Args)
+//
+// The file is re-read as soon as its modification time is changed:
+//
+//	kv:
+//	  service:
+//	    name: example        # registry/service/name
+//	  service/id: 42         # registry/service/id
+//	services:
+//	  - id: api-1
+//	    name: api
+//	    address: 127.0.0.1
+//	    port: 8080
+//	    tags: [http]
+//	    meta: {version: "1.2"}
+//	    status: passing      # passing (by default), warning or critical
+//
+// Register, Deregister, Set and Delete change only the in-memory overlay,
+// the file itself is never written. The watchers are woken up by the reload
+// of the file and by the changes of the overlay, the keys have no modify indexes.
+// The KV and the Discovery of the backend implement io.Closer, the Close
+// of any of them (or of the registry) stops the polling of the file.
+package file
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/trafficstars/registry"
+)
+
+const defaultPollInterval = time.Second
+
+func init() {
+	registry.RegisterDriver("file", func(dsn *url.URL) (registry.KV, registry.Discovery, error) {
+		src := newSource(dsn.Host+dsn.Path, dsn.Query().Get("dc"))
+		if err := src.load(); err != nil {
+			return nil, nil, err
+		}
+		if interval := dsn.Query().Get("poll_interval"); len(interval) != 0 {
+			if v, err := strconv.ParseInt(interval, 10, 64); err == nil && v > 0 {
+				src.pollInterval = time.Duration(v) * time.Second
+			}
+		}
+		go src.supervisor()
+		return newKV(src), newDiscovery(src), nil
+	})
+}
+
+type fileService struct {
+	ID         string            `yaml:"id"`
+	Name       string            `yaml:"name"`
+	Datacenter string            `yaml:"datacenter"`
+	Address    string            `yaml:"address"`
+	Port       int               `yaml:"port"`
+	Tags       []string          `yaml:"tags"`
+	Meta       map[string]string `yaml:"meta"`
+	Status     string            `yaml:"status"`
+}
+
+type fileContent struct {
+	KV       map[string]interface{} `yaml:"kv"`
+	Services []fileService          `yaml:"services"`
+}
+
+// source keeps the last successfully loaded state of the file
+type source struct {
+	mx           sync.RWMutex
+	filename     string
+	datacenter   string
+	pollInterval time.Duration
+	modTime      time.Time
+	values       map[string]string
+	services     []registry.Service
+	version      uint64        // Version of the state of the file and of the overlays
+	changed      chan struct{} // Closed and replaced on every change of the version
+	quit         chan struct{}
+	closeOnce    sync.Once
+}
+
+func newSource(filename, datacenter string) *source {
+	return &source{
+		filename:     filename,
+		datacenter:   datacenter,
+		pollInterval: defaultPollInterval,
+		version:      1,
+		changed:      make(chan struct{}),
+		quit:         make(chan struct{}),
+	}
+}
+
+// Close stops the polling of the file
+func (src *source) Close() error {
+	src.closeOnce.Do(func() { close(src.quit) })
+	return nil
+}
+
+func (src *source) load() error {
+	info, err := os.Stat(src.filename)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(src.filename)
+	if err != nil {
+		return err
+	}
+	var content fileContent
+	if err := yaml.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("%s: %v", src.filename, err)
+	}
+
+	values := map[string]string{}
+	flatten(registry.RegistryPrefix, content.KV, values)
+
+	services := make([]registry.Service, 0, len(content.Services))
+	for _, srv := range content.Services {
+		status, err := parseStatus(srv.Status)
+		if err != nil {
+			return fmt.Errorf("%s: service %q: %v", src.filename, srv.ID, err)
+		}
+		if len(srv.Datacenter) == 0 {
+			srv.Datacenter = src.datacenter
+		}
+		services = append(services, registry.Service{
+			ID:         srv.ID,
+			Name:       srv.Name,
+			Datacenter: srv.Datacenter,
+			Address:    srv.Address,
+			Port:       srv.Port,
+			Tags:       srv.Tags,
+			Meta:       srv.Meta,
+			Status:     status,
+		})
+	}
+
+	src.mx.Lock()
+	src.modTime = info.ModTime()
+	src.values = values
+	src.services = services
+	src.commit()
+	src.mx.Unlock()
+	return nil
+}
+
+// notify the watchers about the change of the overlay
+func (src *source) notify() {
+	src.mx.Lock()
+	src.commit()
+	src.mx.Unlock()
+}
+
+// commit increments the version and wakes up the watchers, mx must be locked
+func (src *source) commit() {
+	src.version++
+	close(src.changed)
+	src.changed = make(chan struct{})
+}
+
+// next blocks until the version differs from the given one unless it's zero,
+// returns the current version
+func (src *source) next(ctx context.Context, version uint64) (uint64, error) {
+	src.mx.RLock()
+	defer src.mx.RUnlock()
+	for version != 0 && version == src.version {
+		changed := src.changed
+		src.mx.RUnlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			src.mx.RLock()
+			return 0, ctx.Err()
+		}
+		src.mx.RLock()
+	}
+	return src.version, nil
+}
+
+// supervisor re-reads the file when the modification time is changed until the source is closed,
+// the previous state is kept if the new content is invalid
+func (src *source) supervisor() {
+	ticker := time.NewTicker(src.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-src.quit:
+			return
+		}
+		info, err := os.Stat(src.filename)
+		if err != nil {
+			continue
+		}
+		src.mx.RLock()
+		changed := !info.ModTime().Equal(src.modTime)
+		src.mx.RUnlock()
+		if changed {
+			src.load()
+		}
+	}
+}
+
+// flatten converts the nested maps to the keys joined by "/",
+// lists are converted to the comma separated values
+func flatten(prefix string, value interface{}, values map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			flatten(prefix+"/"+key, item, values)
+		}
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		values[prefix] = strings.Join(items, ",")
+	case nil:
+	default:
+		values[prefix] = fmt.Sprint(v)
+	}
+}
+
+func parseStatus(status string) (int8, error) {
+	switch status {
+	case "", "passing":
+		return registry.SERVICE_STATUS_PASSING, nil
+	case "warning":
+		return registry.SERVICE_STATUS_WARNING, nil
+	case "critical":
+		return registry.SERVICE_STATUS_CRITICAL, nil
+	}
+	return 0, fmt.Errorf("invalid status %q", status)
+}
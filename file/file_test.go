@@ -0,0 +1,191 @@
+package file
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/trafficstars/registry"
+)
+
+const testRegistryFile = `
+kv:
+  service:
+    name: example
+    hosts: [a, b]
+  service/id: 42
+services:
+  - id: api-1
+    name: api
+    address: 127.0.0.1
+    port: 8080
+    tags: [http]
+  - id: api-2
+    name: api
+    address: 127.0.0.2
+    port: 8080
+    datacenter: dc2
+    status: critical
+`
+
+type testConfig struct {
+	sync.Mutex
+	ID    int      `registry:"service/id"`
+	Name  string   `registry:"service/name"`
+	Hosts []string `registry:"service/hosts"`
+}
+
+func writeFile(t *testing.T, filename, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_File(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registry.yaml")
+	writeFile(t, filename, testRegistryFile, time.Now().Add(-time.Minute))
+
+	r, err := registry.New("file://"+filename+"?dc=dc1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	config := &testConfig{}
+	if assert.NoError(t, r.Bind(config)) {
+		r.Refresh()
+		config.Lock()
+		assert.Equal(t, 42, config.ID)
+		assert.Equal(t, "example", config.Name)
+		assert.Equal(t, []string{"a", "b"}, config.Hosts)
+		config.Unlock()
+	}
+
+	kv := r.KV()
+	if list, err := kv.List(registry.RegistryPrefix + "/service/"); assert.NoError(t, err) {
+		assert.Len(t, list, 3)
+	}
+	assert.NoError(t, kv.Set("service/name", "overlay"))
+	assert.NoError(t, kv.Delete("service/id"))
+	if list, err := kv.List(registry.RegistryPrefix + "/service/"); assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{
+			registry.RegistryPrefix + "/service/name":  "overlay",
+			registry.RegistryPrefix + "/service/hosts": "a,b",
+		}, list)
+	}
+
+	catalogue := r.Discovery()
+	services, err := catalogue.Lookup(&registry.Filter{Service: "api", Datacenter: "all"})
+	if assert.NoError(t, err) && assert.Len(t, services, 2) {
+		assert.Equal(t, "dc1", services[0].Datacenter)
+		assert.Equal(t, registry.SERVICE_STATUS_PASSING, services[0].Status)
+		assert.Equal(t, registry.SERVICE_STATUS_CRITICAL, services[1].Status)
+	}
+
+	assert.NoError(t, catalogue.Register(registry.ServiceOptions{
+		ID:      "api-3",
+		Name:    "api",
+		Address: "127.0.0.3:8080",
+		Check:   registry.CheckOptions{HTTP: "http://127.0.0.3:8080/check"},
+	}))
+	assert.NoError(t, catalogue.Deregister("api-1"))
+	services, err = catalogue.Lookup(&registry.Filter{Service: "api", Status: registry.SERVICE_STATUS_PASSING})
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, "api-3", services[0].ID)
+	}
+
+	// Both static and registered instances can be in maintenance
+	assert.NoError(t, catalogue.EnableMaintenance("api-2", "test"))
+	assert.NoError(t, catalogue.EnableMaintenance("api-3", "test"))
+	assert.Error(t, catalogue.EnableMaintenance("unknown", "test"))
+	services, _ = catalogue.Lookup(&registry.Filter{Service: "api", Datacenter: "all"})
+	for _, srv := range services {
+		assert.True(t, srv.Maintenance, srv.ID)
+		assert.Equal(t, registry.SERVICE_STATUS_CRITICAL, srv.Status, srv.ID)
+	}
+	assert.NoError(t, catalogue.DisableMaintenance("api-3"))
+	services, _ = catalogue.Lookup(&registry.Filter{Service: "api", Status: registry.SERVICE_STATUS_PASSING})
+	assert.Len(t, services, 1)
+
+	// Reload the changed file
+	writeFile(t, filename, "kv:\n  service/id: 43\n", time.Now())
+	src := catalogue.(*discovery).source
+	if assert.NoError(t, src.load()) {
+		v, _ := kv.Get("service/id")
+		assert.Equal(t, "", v, "the key is deleted in the overlay")
+		v, _ = kv.Get("service/name")
+		assert.Equal(t, "overlay", v)
+		services, _ = catalogue.Lookup(nil)
+		assert.Len(t, services, 1)
+	}
+
+	// Invalid content keeps the previous state
+	writeFile(t, filename, "services: [{status: unknown}]", time.Now())
+	assert.Error(t, src.load())
+	src.mx.RLock()
+	assert.Len(t, src.values, 1)
+	src.mx.RUnlock()
+}
+
+func Test_FileReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registry.yaml")
+	writeFile(t, filename, testRegistryFile, time.Now().Add(-time.Minute))
+
+	r, err := registry.New("file://"+filename+"?poll_interval=1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.KV().(io.Closer).Close()
+
+	config := &testConfig{}
+	if !assert.NoError(t, r.Bind(config)) {
+		return
+	}
+	name := func() string {
+		config.Lock()
+		defer config.Unlock()
+		return config.Name
+	}
+	assert.Eventually(t, func() bool { return name() == "example" }, 5*time.Second, 10*time.Millisecond)
+
+	// The reload of the file updates the bound configs
+	writeFile(t, filename, "kv:\n  service/name: reloaded\n", time.Now())
+	assert.Eventually(t, func() bool { return name() == "reloaded" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_FileClose(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registry.yaml")
+	writeFile(t, filename, "kv:\n  service/name: example\n", time.Now().Add(-time.Minute))
+
+	src := newSource(filename, "dc1")
+	src.pollInterval = 10 * time.Millisecond
+	if !assert.NoError(t, src.load()) {
+		return
+	}
+	version, _ := src.next(context.Background(), 0)
+	go src.supervisor()
+
+	writeFile(t, filename, "kv:\n  service/name: changed\n", time.Now().Add(-time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := src.next(ctx, version)
+	assert.NoError(t, err, "the file is reloaded")
+
+	// The closed source doesn't poll the file anymore
+	assert.NoError(t, src.Close())
+	assert.NoError(t, src.Close())
+	time.Sleep(50 * time.Millisecond)
+	writeFile(t, filename, "kv:\n  service/name: closed\n", time.Now())
+	time.Sleep(50 * time.Millisecond)
+	v, _ := newKV(src).Get("service/name")
+	assert.Equal(t, "changed", v)
+}
@@ -0,0 +1,109 @@
+package file
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/trafficstars/registry"
+)
+
+// kv reads the values from the file, the changes are kept in the overlay
+type kv struct {
+	source  *source
+	mx      sync.RWMutex
+	overlay map[string]*string // nil value means the deleted key
+}
+
+func newKV(src *source) *kv {
+	return &kv{source: src, overlay: map[string]*string{}}
+}
+
+func (kv *kv) Get(key string) (string, error) {
+	key = registry.RegistryPrefix + "/" + key
+	kv.mx.RLock()
+	value, ok := kv.overlay[key]
+	kv.mx.RUnlock()
+	if ok {
+		if value == nil {
+			return "", nil
+		}
+		return *value, nil
+	}
+	kv.source.mx.RLock()
+	defer kv.source.mx.RUnlock()
+	return kv.source.values[key], nil
+}
+
+func (kv *kv) Set(key, value string) error {
+	kv.mx.Lock()
+	kv.overlay[registry.RegistryPrefix+"/"+key] = &value
+	kv.mx.Unlock()
+	kv.source.notify()
+	return nil
+}
+
+func (kv *kv) List(prefix string) (map[string]string, error) {
+	list := map[string]string{}
+	kv.source.mx.RLock()
+	for key, value := range kv.source.values {
+		if strings.HasPrefix(key, prefix) {
+			list[key] = value
+		}
+	}
+	kv.source.mx.RUnlock()
+
+	kv.mx.RLock()
+	defer kv.mx.RUnlock()
+	for key, value := range kv.overlay {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if value == nil {
+			delete(list, key)
+		} else {
+			list[key] = *value
+		}
+	}
+	return list, nil
+}
+
+func (kv *kv) Delete(key string) error {
+	kv.mx.Lock()
+	kv.overlay[registry.RegistryPrefix+"/"+key] = nil
+	kv.mx.Unlock()
+	kv.source.notify()
+	return nil
+}
+
+// Close stops the polling of the file
+func (kv *kv) Close() error {
+	return kv.source.Close()
+}
+
+func (kv *kv) Watch(ctx context.Context, key string) (<-chan registry.KVEvent, error) {
+	key = registry.RegistryPrefix + "/" + key
+	return registry.WatchKV(ctx, kv.fetch(key, func(k string) bool { return k == key }))
+}
+
+func (kv *kv) WatchPrefix(ctx context.Context, prefix string) (<-chan registry.KVEvent, error) {
+	return registry.WatchKV(ctx, kv.fetch(prefix, func(string) bool { return true }))
+}
+
+// fetch the keys of the prefix after the next change of the file or of the overlay
+func (kv *kv) fetch(prefix string, match func(key string) bool) registry.KVFetchFunc {
+	return func(ctx context.Context, index uint64) (map[string]registry.KVEntry, uint64, error) {
+		version, err := kv.source.next(ctx, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		list, _ := kv.List(prefix)
+		entries := make(map[string]registry.KVEntry, len(list))
+		for key, value := range list {
+			if match(key) {
+				entries[key] = registry.KVEntry{Value: value}
+			}
+		}
+		return entries, version, nil
+	}
+}
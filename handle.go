@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DrainReason is the maintenance reason of the drained service
+const DrainReason = "draining"
+
+// ServiceHandle controls the lifecycle of the registered service instance
+type ServiceHandle struct {
+	discovery Discovery
+	id        string
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{}
+}
+
+// RegisterService in the discovery and returns its handle,
+// the service has to be deregistered by the Close of the handle
+func RegisterService(discovery Discovery, options ServiceOptions) (*ServiceHandle, error) {
+	if err := discovery.Register(options); err != nil {
+		return nil, err
+	}
+	return &ServiceHandle{
+		discovery: discovery,
+		id:        options.ID,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// ID of the registered service
+func (h *ServiceHandle) ID() string {
+	return h.id
+}
+
+// Drain enables the maintenance mode of the service, so the balancers
+// stop routing the new requests to it while the current ones are finished
+func (h *ServiceHandle) Drain() error {
+	return h.discovery.EnableMaintenance(h.id, DrainReason)
+}
+
+// Close deregisters the service, it's safe to call Close several times
+func (h *ServiceHandle) Close() error {
+	h.closeOnce.Do(func() {
+		h.closeErr = h.discovery.Deregister(h.id)
+		close(h.done)
+	})
+	return h.closeErr
+}
+
+// Done is closed when the service is deregistered
+func (h *ServiceHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// CloseOnSignal drains the service as soon as one of the signals (SIGTERM by default)
+// is received and deregisters it after the drain delay.
+//
+// Then the signal is raised again, so the default action
+// (the termination of the process) is not lost.
+func (h *ServiceHandle) CloseOnSignal(drainDelay time.Duration, signals ...os.Signal) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		select {
+		case sig := <-ch:
+			if h.Drain() == nil {
+				time.Sleep(drainDelay)
+			}
+			h.Close()
+			signal.Stop(ch)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-h.done:
+			signal.Stop(ch)
+		}
+	}()
+}
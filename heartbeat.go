@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var errTTLNotSupported = errors.New("registry: discovery doesn't support TTL checks")
+
+// TTLUpdater is implemented by the Discovery backends which support the TTL checks
+type TTLUpdater interface {
+	// UpdateTTL marks the TTL check by the status (SERVICE_STATUS_PASSING,
+	// SERVICE_STATUS_WARNING or SERVICE_STATUS_CRITICAL) with the note
+	UpdateTTL(checkID string, status int8, note string) error
+}
+
+// HealthFunc returns the current status of the service and the note describing it
+type HealthFunc func() (status int8, note string)
+
+// Heartbeat keeps the TTL check alive by the status returned by the health function,
+// the check is updated every interval until the context is done. If the health
+// function is nil the check is always passing.
+//
+// The first update is done immediately and its error is returned,
+// so the unknown check is detected on the start. The next errors are logged
+// and the check is updated again after the interval.
+func Heartbeat(ctx context.Context, discovery Discovery, checkID string, interval time.Duration, health HealthFunc) error {
+	if interval <= 0 {
+		return fmt.Errorf("registry: heartbeat interval must be positive: %s", interval)
+	}
+	updater, ok := discovery.(TTLUpdater)
+	if !ok {
+		return errTTLNotSupported
+	}
+	if health == nil {
+		health = func() (int8, string) { return SERVICE_STATUS_PASSING, "" }
+	}
+	update := func() error {
+		status, note := health()
+		return updater.UpdateTTL(checkID, status, note)
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := update(); err != nil {
+					log.Printf("registry: heartbeat %q: %s", checkID, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -1,9 +1,15 @@
 package registry
 
 import (
+	"context"
+	"time"
+
 	"github.com/hashicorp/consul/api"
 )
 
+// blockingQueryWaitTime bounds the duration of one blocking query
+const blockingQueryWaitTime = 5 * time.Minute
+
 type kv struct {
 	client *api.KV
 }
@@ -44,3 +50,39 @@ func (kv *kv) Delete(key string) error {
 	}
 	return nil
 }
+
+func (kv *kv) Watch(ctx context.Context, key string) (<-chan KVEvent, error) {
+	return WatchKV(ctx, kv.fetch(RegistryPrefix+"/"+key, false))
+}
+
+func (kv *kv) WatchPrefix(ctx context.Context, prefix string) (<-chan KVEvent, error) {
+	return WatchKV(ctx, kv.fetch(prefix, true))
+}
+
+// fetch the key or the prefix by the blocking queries
+func (kv *kv) fetch(key string, recurse bool) KVFetchFunc {
+	return func(ctx context.Context, index uint64) (map[string]KVEntry, uint64, error) {
+		var (
+			items api.KVPairs
+			meta  *api.QueryMeta
+			err   error
+			q     = (&api.QueryOptions{WaitIndex: index, WaitTime: blockingQueryWaitTime}).WithContext(ctx)
+		)
+		if recurse {
+			items, meta, err = kv.client.List(key, q)
+		} else {
+			var item *api.KVPair
+			if item, meta, err = kv.client.Get(key, q); item != nil {
+				items = append(items, item)
+			}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		entries := make(map[string]KVEntry, len(items))
+		for _, item := range items {
+			entries[item.Key] = KVEntry{Value: string(item.Value), ModifyIndex: item.ModifyIndex}
+		}
+		return entries, meta.LastIndex, nil
+	}
+}
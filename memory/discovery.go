@@ -0,0 +1,265 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/trafficstars/registry"
+)
+
+// Discovery keeps the service catalogue in the process memory.
+//
+// As in Consul, the instance registered without checks has undefined status
+// and the instance with checks is critical until it's marked as passing.
+type Discovery struct {
+	mx         sync.RWMutex
+	index      uint64
+	datacenter string
+	services   map[string]registry.Service
+	ttlChecks  map[string]string // TTL check ID => service ID
+	localNode  string
+	nodes      map[string]*registry.Coordinate
+	changed    chan struct{}
+}
+
+// NewDiscovery returns empty service catalogue of the datacenter
+func NewDiscovery(datacenter string) *Discovery {
+	return &Discovery{
+		index:      1,
+		datacenter: datacenter,
+		services:   map[string]registry.Service{},
+		ttlChecks:  map[string]string{},
+		nodes:      map[string]*registry.Coordinate{},
+		changed:    make(chan struct{}),
+	}
+}
+
+// Register the service instance in the catalogue
+func (d *Discovery) Register(options registry.ServiceOptions) error {
+	host, port, err := registry.SplitServiceAddress(options.Address)
+	if err != nil {
+		return err
+	}
+	status := registry.SERVICE_STATUS_UNDEFINED
+	checks := options.HealthChecks()
+	if len(checks) != 0 {
+		status = registry.SERVICE_STATUS_CRITICAL
+	}
+	d.mx.Lock()
+	for _, check := range checks {
+		if check.TTL != "" {
+			d.ttlChecks[check.ID] = options.ID
+		}
+	}
+	d.mx.Unlock()
+	d.mx.RLock()
+	node := d.localNode
+	d.mx.RUnlock()
+	d.Add(registry.Service{
+		ID:         options.ID,
+		Name:       options.Name,
+		Datacenter: d.datacenter,
+		Node:       node,
+		Address:    host,
+		Port:       port,
+		Tags:       append(append([]string{}, options.Tags...), "DC="+d.datacenter),
+		Meta:       copyMeta(options.Meta),
+		Status:     status,
+	})
+	return nil
+}
+
+// Datacenter passed to NewDiscovery
+func (d *Discovery) Datacenter() string {
+	return d.datacenter
+}
+
+// SetLocalNode defines the node of the process,
+// the registered services are placed on this node
+func (d *Discovery) SetLocalNode(node string) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.localNode = node
+}
+
+// SetCoordinate of the node, so the nearest balancing
+// can be tested with the synthetic coordinates
+func (d *Discovery) SetCoordinate(node string, coord *registry.Coordinate) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.nodes[node] = coord
+	d.commit()
+}
+
+// Coordinates of the local node and of all nodes
+func (d *Discovery) Coordinates() (*registry.Coordinate, map[string]*registry.Coordinate, error) {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	nodes := make(map[string]*registry.Coordinate, len(d.nodes))
+	for node, coord := range d.nodes {
+		nodes[node] = coord
+	}
+	return d.nodes[d.localNode], nodes, nil
+}
+
+// Add service instances to the catalogue as is,
+// so the instances of the other datacenters can be defined
+func (d *Discovery) Add(services ...registry.Service) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	for _, srv := range services {
+		d.services[srv.ID] = srv
+	}
+	d.commit()
+}
+
+// Deregister the service instance
+func (d *Discovery) Deregister(ident string) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	delete(d.services, ident)
+	for checkID, serviceID := range d.ttlChecks {
+		if serviceID == ident {
+			delete(d.ttlChecks, checkID)
+		}
+	}
+	d.commit()
+	return nil
+}
+
+// Lookup services by filter
+func (d *Discovery) Lookup(filter *registry.Filter) ([]registry.Service, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	return d.lookup(filter), nil
+}
+
+// Watch streams the healthy services as soon as the catalogue is changed
+func (d *Discovery) Watch(ctx context.Context, filter *registry.Filter) (<-chan []registry.Service, error) {
+	return registry.WatchServices(ctx, filter, func(ctx context.Context, index uint64) ([]registry.Service, uint64, error) {
+		d.mx.RLock()
+		for index != 0 && index == d.index {
+			changed := d.changed
+			d.mx.RUnlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			d.mx.RLock()
+		}
+		defer d.mx.RUnlock()
+		return d.lookup(filter), d.index, nil
+	})
+}
+
+// lookup services by filter, mx must be locked
+func (d *Discovery) lookup(filter *registry.Filter) []registry.Service {
+	filter = filter.WithoutAllDatacenter()
+	var services []registry.Service
+	for _, srv := range d.services {
+		if srv.Maintenance {
+			srv.Status = registry.SERVICE_STATUS_CRITICAL
+		}
+		if srv.Match(filter) {
+			srv.Tags = append([]string{}, srv.Tags...)
+			srv.Meta = copyMeta(srv.Meta)
+			services = append(services, srv)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services
+}
+
+// commit increments the index and wakes up the watchers, mx must be locked
+func (d *Discovery) commit() {
+	d.index++
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// SetStatus of the service instance
+func (d *Discovery) SetStatus(ident string, status int8) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	srv, ok := d.services[ident]
+	if !ok {
+		return fmt.Errorf("unknown service %q", ident)
+	}
+	srv.Status = status
+	d.services[ident] = srv
+	d.commit()
+	return nil
+}
+
+// UpdateTTL of the check defined on Register, the catalogue keeps
+// the only status per instance so it's changed by the check status
+func (d *Discovery) UpdateTTL(checkID string, status int8, note string) error {
+	d.mx.RLock()
+	ident, ok := d.ttlChecks[checkID]
+	d.mx.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown TTL check %q", checkID)
+	}
+	return d.SetStatus(ident, status)
+}
+
+// EnableMaintenance of the service instance, it's critical until the maintenance is disabled
+func (d *Discovery) EnableMaintenance(serviceID, reason string) error {
+	return d.setMaintenance(serviceID, true)
+}
+
+// DisableMaintenance of the service instance
+func (d *Discovery) DisableMaintenance(serviceID string) error {
+	return d.setMaintenance(serviceID, false)
+}
+
+func (d *Discovery) setMaintenance(ident string, maintenance bool) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	srv, ok := d.services[ident]
+	if !ok {
+		return fmt.Errorf("unknown service %q", ident)
+	}
+	srv.Maintenance = maintenance
+	d.services[ident] = srv
+	d.commit()
+	return nil
+}
+
+// Pass marks the service instance as passing
+func (d *Discovery) Pass(ident string) error {
+	return d.SetStatus(ident, registry.SERVICE_STATUS_PASSING)
+}
+
+// Warn marks the service instance as warning
+func (d *Discovery) Warn(ident string) error {
+	return d.SetStatus(ident, registry.SERVICE_STATUS_WARNING)
+}
+
+// Fail marks the service instance as critical
+func (d *Discovery) Fail(ident string) error {
+	return d.SetStatus(ident, registry.SERVICE_STATUS_CRITICAL)
+}
+
+func copyMeta(meta map[string]string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	c := make(map[string]string, len(meta))
+	for key, value := range meta {
+		c[key] = value
+	}
+	return c
+}
+
+var (
+	_ registry.Discovery          = (*Discovery)(nil)
+	_ registry.TTLUpdater         = (*Discovery)(nil)
+	_ registry.CoordinateProvider = (*Discovery)(nil)
+)
@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/trafficstars/registry"
+)
+
+type entry struct {
+	value string
+	index uint64
+}
+
+// KV storage in the process memory
+type KV struct {
+	mx      sync.RWMutex
+	index   uint64
+	values  map[string]entry
+	changed chan struct{}
+}
+
+// NewKV returns empty KV storage
+func NewKV() *KV {
+	return &KV{index: 1, values: map[string]entry{}, changed: make(chan struct{})}
+}
+
+// Get value of the key
+func (kv *KV) Get(key string) (string, error) {
+	kv.mx.RLock()
+	defer kv.mx.RUnlock()
+	return kv.values[registry.RegistryPrefix+"/"+key].value, nil
+}
+
+// Set value of the key
+func (kv *KV) Set(key, value string) error {
+	kv.mx.Lock()
+	defer kv.mx.Unlock()
+	kv.values[registry.RegistryPrefix+"/"+key] = entry{value: value, index: kv.commit()}
+	return nil
+}
+
+// List all keys which start with the prefix
+func (kv *KV) List(prefix string) (map[string]string, error) {
+	kv.mx.RLock()
+	defer kv.mx.RUnlock()
+	list := map[string]string{}
+	for key, entry := range kv.values {
+		if strings.HasPrefix(key, prefix) {
+			list[key] = entry.value
+		}
+	}
+	return list, nil
+}
+
+// Delete the key
+func (kv *KV) Delete(key string) error {
+	kv.mx.Lock()
+	defer kv.mx.Unlock()
+	delete(kv.values, registry.RegistryPrefix+"/"+key)
+	kv.commit()
+	return nil
+}
+
+// Watch streams the changes of the key
+func (kv *KV) Watch(ctx context.Context, key string) (<-chan registry.KVEvent, error) {
+	key = registry.RegistryPrefix + "/" + key
+	return registry.WatchKV(ctx, kv.fetch(func(k string) bool { return k == key }))
+}
+
+// WatchPrefix streams the changes of all keys which start with the prefix
+func (kv *KV) WatchPrefix(ctx context.Context, prefix string) (<-chan registry.KVEvent, error) {
+	return registry.WatchKV(ctx, kv.fetch(func(k string) bool { return strings.HasPrefix(k, prefix) }))
+}
+
+// fetch the matched keys as soon as the storage is changed after the index
+func (kv *KV) fetch(match func(key string) bool) registry.KVFetchFunc {
+	return func(ctx context.Context, index uint64) (map[string]registry.KVEntry, uint64, error) {
+		kv.mx.RLock()
+		for index != 0 && index == kv.index {
+			changed := kv.changed
+			kv.mx.RUnlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			kv.mx.RLock()
+		}
+		defer kv.mx.RUnlock()
+		entries := map[string]registry.KVEntry{}
+		for key, entry := range kv.values {
+			if match(key) {
+				entries[key] = registry.KVEntry{Value: entry.value, ModifyIndex: entry.index}
+			}
+		}
+		return entries, kv.index, nil
+	}
+}
+
+// commit increments the index and wakes up the watchers, mx must be locked
+func (kv *KV) commit() uint64 {
+	kv.index++
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+	return kv.index
+}
+
+var _ registry.KV = (*KV)(nil)
@@ -0,0 +1,24 @@
+// Package memory implements the registry backend which keeps the KV storage
+// and the service catalogue in the process memory.
+//
+// The backend is selected by the mem:// DSN scheme:
+//
+//	import _ "github.com/trafficstars/registry/memory"
+//
+//	r, _ := registry.New("mem://?dc=dc1", os.Args)
+//	r.Discovery().(*memory.Discovery).Fail("service-id")
+//
+// It is intended for the tests of the code which depends on the registry.
+package memory
+
+import (
+	"net/url"
+
+	"github.com/trafficstars/registry"
+)
+
+func init() {
+	registry.RegisterDriver("mem", func(dsn *url.URL) (registry.KV, registry.Discovery, error) {
+		return NewKV(), NewDiscovery(dsn.Query().Get("dc")), nil
+	})
+}
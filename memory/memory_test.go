@@ -0,0 +1,222 @@
+package memory
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/trafficstars/registry"
+)
+
+type testConfig struct {
+	sync.Mutex
+	Name  string `default:"default" registry:"service/name"`
+	Limit int    `default:"10"      registry:"service/limit"`
+}
+
+func Test_Registry(t *testing.T) {
+	r, err := registry.New("mem://?dc=dc1", os.Args)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	config := &testConfig{}
+	if assert.NoError(t, r.Bind(config)) {
+		config.Lock()
+		assert.Equal(t, "default", config.Name)
+		config.Unlock()
+	}
+
+	kv := r.KV()
+	assert.NoError(t, kv.Set("service/name", "test"))
+	assert.NoError(t, kv.Set("service/limit", "100"))
+	r.Refresh()
+
+	config.Lock()
+	assert.Equal(t, "test", config.Name)
+	assert.Equal(t, 100, config.Limit)
+	config.Unlock()
+
+	if list, err := kv.List(registry.RegistryPrefix + "/service/"); assert.NoError(t, err) {
+		assert.Len(t, list, 2)
+	}
+	if assert.NoError(t, kv.Delete("service/name")) {
+		v, _ := kv.Get("service/name")
+		assert.Equal(t, "", v)
+	}
+}
+
+func Test_Discovery(t *testing.T) {
+	d := NewDiscovery("dc1")
+	assert.NoError(t, d.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "127.0.0.1:8080"}))
+	assert.NoError(t, d.Register(registry.ServiceOptions{
+		ID:      "api-2",
+		Name:    "api",
+		Address: "http://127.0.0.2:8080",
+		Check:   registry.CheckOptions{HTTP: "http://127.0.0.2:8080/check"},
+	}))
+	d.Add(registry.Service{ID: "api-3", Name: "api", Datacenter: "dc2", Status: registry.SERVICE_STATUS_PASSING})
+	assert.NoError(t, d.Register(registry.ServiceOptions{
+		ID:      "worker-1",
+		Name:    "worker",
+		Address: "127.0.0.3",
+		Checks:  []registry.CheckOptions{{TTL: "10s"}},
+	}))
+	if services, _ := d.Lookup(&registry.Filter{Service: "worker"}); assert.Len(t, services, 1) {
+		assert.Equal(t, registry.SERVICE_STATUS_CRITICAL, services[0].Status)
+	}
+	d.Deregister("worker-1")
+
+	services, err := d.Lookup(&registry.Filter{Service: "api", Datacenter: "dc1"})
+	if assert.NoError(t, err) && assert.Len(t, services, 2) {
+		assert.Equal(t, registry.SERVICE_STATUS_UNDEFINED, services[0].Status)
+		assert.Equal(t, registry.SERVICE_STATUS_CRITICAL, services[1].Status)
+		assert.Equal(t, "127.0.0.2", services[1].Address)
+		assert.Equal(t, 8080, services[1].Port)
+		assert.Equal(t, []string{"DC=dc1"}, services[1].Tags)
+	}
+
+	assert.NoError(t, d.Pass("api-2"))
+	assert.NoError(t, d.Warn("api-1"))
+	assert.Error(t, d.Fail("unknown"))
+
+	services, err = d.Lookup(&registry.Filter{Status: registry.SERVICE_STATUS_PASSING, Datacenter: "all"})
+	if assert.NoError(t, err) && assert.Len(t, services, 2) {
+		assert.Equal(t, "api-2", services[0].ID)
+		assert.Equal(t, "api-3", services[1].ID)
+	}
+
+	assert.NoError(t, d.Deregister("api-2"))
+	services, _ = d.Lookup(nil)
+	assert.Len(t, services, 2)
+}
+
+func Test_DiscoveryMaintenance(t *testing.T) {
+	d := NewDiscovery("dc1")
+	d.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "127.0.0.1:8080"})
+	d.Pass("api-1")
+
+	assert.Error(t, d.EnableMaintenance("unknown", "test"))
+	if assert.NoError(t, d.EnableMaintenance("api-1", "test")) {
+		services, _ := d.Lookup(nil)
+		if assert.Len(t, services, 1) {
+			assert.True(t, services[0].Maintenance)
+			assert.Equal(t, registry.SERVICE_STATUS_CRITICAL, services[0].Status)
+		}
+	}
+	if assert.NoError(t, d.DisableMaintenance("api-1")) {
+		services, _ := d.Lookup(nil)
+		if assert.Len(t, services, 1) {
+			assert.False(t, services[0].Maintenance)
+			assert.Equal(t, registry.SERVICE_STATUS_PASSING, services[0].Status, "the previous status is restored")
+		}
+	}
+}
+
+func Test_DiscoveryMeta(t *testing.T) {
+	d := NewDiscovery("dc1")
+	meta := map[string]string{"version": "1.2", "zone": "a"}
+	d.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "127.0.0.1:8080", Meta: meta})
+	d.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "127.0.0.2:8080", Meta: map[string]string{"version": "1.1"}})
+	meta["zone"] = "b"
+
+	services, err := d.Lookup(&registry.Filter{Meta: map[string]string{"version": "1.2"}})
+	if assert.NoError(t, err) && assert.Len(t, services, 1) {
+		assert.Equal(t, map[string]string{"version": "1.2", "zone": "a"}, services[0].Meta)
+	}
+	services, _ = d.Lookup(&registry.Filter{Meta: map[string]string{"version": "1.2", "zone": "b"}})
+	assert.Len(t, services, 0)
+}
+
+func Test_KVWatch(t *testing.T) {
+	kv := NewKV()
+	kv.Set("flags/a", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := kv.WatchPrefix(ctx, registry.RegistryPrefix+"/flags/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, registry.KVEvent{Type: registry.KV_EVENT_PUT, Key: "registry/flags/a", Value: "1", ModifyIndex: 2}, <-events)
+
+	kv.Set("other", "-")
+	kv.Set("flags/a", "2")
+	assert.Equal(t, registry.KVEvent{Type: registry.KV_EVENT_PUT, Key: "registry/flags/a", Value: "2", ModifyIndex: 4}, <-events)
+
+	kv.Delete("flags/a")
+	assert.Equal(t, registry.KVEvent{Type: registry.KV_EVENT_DELETE, Key: "registry/flags/a", ModifyIndex: 5}, <-events)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok, "the channel has to be closed")
+}
+
+func Test_DiscoveryWatch(t *testing.T) {
+	d := NewDiscovery("dc1")
+	d.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "127.0.0.1:8080"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := d.Watch(ctx, &registry.Filter{Service: "api"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if services := <-updates; assert.Len(t, services, 1) {
+		assert.Equal(t, "api-1", services[0].ID)
+	}
+
+	// The changes of the other services are not sent
+	d.Register(registry.ServiceOptions{ID: "db-1", Name: "db", Address: "127.0.0.1:5432"})
+	d.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "127.0.0.2:8080"})
+	if services := <-updates; assert.Len(t, services, 2) {
+		assert.Equal(t, "api-2", services[1].ID)
+	}
+
+	d.Fail("api-1")
+	if services := <-updates; assert.Len(t, services, 1) {
+		assert.Equal(t, "api-2", services[0].ID)
+	}
+
+	cancel()
+	_, ok := <-updates
+	assert.False(t, ok, "the channel has to be closed")
+}
+
+func Test_Heartbeat(t *testing.T) {
+	d := NewDiscovery("dc1")
+	d.Register(registry.ServiceOptions{
+		ID:      "worker-1",
+		Name:    "worker",
+		Address: "127.0.0.1",
+		Check:   registry.CheckOptions{TTL: "10s"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Error(t, registry.Heartbeat(ctx, d, "unknown", time.Millisecond, nil))
+	assert.Error(t, registry.Heartbeat(ctx, d, "worker-1", 0, nil), "the zero interval is rejected instead of the panic")
+
+	status := int32(registry.SERVICE_STATUS_PASSING)
+	health := func() (int8, string) { return int8(atomic.LoadInt32(&status)), "" }
+	if !assert.NoError(t, registry.Heartbeat(ctx, d, "worker-1", 10*time.Millisecond, health)) {
+		return
+	}
+	lookupStatus := func() int8 {
+		services, _ := d.Lookup(&registry.Filter{ID: "worker-1"})
+		if len(services) == 0 {
+			return 0
+		}
+		return services[0].Status
+	}
+	assert.Equal(t, registry.SERVICE_STATUS_PASSING, lookupStatus())
+
+	atomic.StoreInt32(&status, int32(registry.SERVICE_STATUS_WARNING))
+	assert.Eventually(t, func() bool { return lookupStatus() == registry.SERVICE_STATUS_WARNING }, time.Second, 10*time.Millisecond)
+}
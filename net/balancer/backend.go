@@ -1,34 +1,65 @@
 package balancer
 
 import (
-	"math"
 	"sync/atomic"
+	"time"
+
+	"github.com/trafficstars/registry"
 )
 
 // Backend describe one service instance info
 type Backend struct {
-	skipCounter    int32
 	requestCounter int32
 	weight         int32
 	hostaddress    string
 	address        string
+	datacenter     string
+	rtt            time.Duration
+	health         *backendHealth
+}
+
+// Report the outcome of the request to the backend, the failing backends
+// are ejected by the outlier detection of the balancer if it's enabled,
+// otherwise the failed backend is skipped for a second
+func (b *Backend) Report(success bool, latency time.Duration) {
+	if b.health != nil {
+		b.health.report(success, latency)
+	}
+}
+
+// Ejected returns true if the backend is ejected by the outlier detection
+func (b *Backend) Ejected() bool {
+	return b.health.isEjected()
+}
+
+// Healthy returns false if the backend fails the active health check of the balancer
+func (b *Backend) Healthy() bool {
+	return b.health == nil || atomic.LoadInt32(&b.health.unhealthy) == 0
 }
 
-// Skip activates skip counter
+// Latency returns the moving average of the reported latency
+func (b *Backend) Latency() time.Duration {
+	if b.health == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&b.health.latency))
+}
+
+// Skip ejects the backend from all strategies for a second,
+// the max ejection percent of the outlier detection is respected
+//
+// Deprecated: use Report instead
 func (b *Backend) Skip() {
-	atomic.StoreInt32(&b.skipCounter, 7)
+	if b.health != nil && b.health.detector != nil {
+		b.health.detector.skip(b.health)
+	}
 }
 
-// DoSkip reduce counter of skips and returns if it necessary to skip this step
+// DoSkip returns true if the backend is skipped or ejected
+//
+// Deprecated: the strategies don't choose the ejected backends, use Ejected instead
 func (b *Backend) DoSkip() bool {
-	counter := atomic.AddInt32(&b.skipCounter, -1)
-	if counter < math.MaxInt32 {
-		// Reset the counter
-		if old := atomic.SwapInt32(&b.skipCounter, 0); old > 0 {
-			atomic.CompareAndSwapInt32(&b.skipCounter, 0, old)
-		}
-	}
-	return counter >= 0
+	return b.Ejected()
 }
 
 // ConcurrentRequestCount returns current amount of concurent requests
@@ -41,40 +72,123 @@ func (b *Backend) IncConcurrentRequest(v int32) int32 {
 	return atomic.AddInt32(&b.requestCounter, v)
 }
 
+// lessLoaded returns true if the backend has less concurrent requests
+// per the weight unit than the other one
+func (b *Backend) lessLoaded(other *Backend) bool {
+	// The requests are compared as (requests+1)/weight without the division
+	return int64(b.ConcurrentRequestCount()+1)*int64(other.loadWeight()) <
+		int64(other.ConcurrentRequestCount()+1)*int64(b.loadWeight())
+}
+
+func (b *Backend) loadWeight() int32 {
+	if b.weight < 1 {
+		return 1
+	}
+	return b.weight
+}
+
 // Address of the backend returns the IP address
 func (b *Backend) Address() string {
 	return b.address
 }
 
+// Datacenter which serves the backend
+func (b *Backend) Datacenter() string {
+	return b.datacenter
+}
+
+// RTT returns the estimated round trip time to the backend,
+// it's measured by the nearest strategy only
+func (b *Backend) RTT() time.Duration {
+	return b.rtt
+}
+
 // Hostname of the backend
 func (b *Backend) Hostname() string {
 	return b.hostaddress
 }
 
+// available returns true if the backend is healthy, isn't ejected
+// and has less concurrent requests than the limit
+func available(backend *Backend, maxRequestsByBackend int) bool {
+	return (maxRequestsByBackend <= 0 || maxRequestsByBackend > backend.ConcurrentRequestCount()) &&
+		backend.Healthy() && !backend.Ejected()
+}
+
 type backends []*Backend
 
-func (b backends) maxWeight() int32 {
-	maxWeight := int32(-1)
+// schedule returns the sequence of the backends by the smooth weighted round robin
+// (as Nginx does), every backend is repeated by its weight and the repeats are
+// interleaved with the other backends as evenly as possible
+func (b backends) schedule() backends {
+	if len(b) == 0 {
+		return nil
+	}
+	var (
+		weights = make([]int64, len(b))
+		current = make([]int64, len(b))
+		divisor = int32(0)
+		total   int64
+	)
 	for _, backend := range b {
-		if backend.weight > maxWeight {
-			maxWeight = backend.weight
+		divisor = gcd(divisor, backend.loadWeight())
+	}
+	for i, backend := range b {
+		weights[i] = int64(backend.loadWeight() / divisor)
+		total += weights[i]
+	}
+	if total > maxScheduleLength {
+		// The weights are scaled down, so the schedule is kept in the bounds
+		scaled := int64(0)
+		for i := range weights {
+			if weights[i] = weights[i] * maxScheduleLength / total; weights[i] < 1 {
+				weights[i] = 1
+			}
+			scaled += weights[i]
 		}
+		total = scaled
 	}
-	return maxWeight
+
+	sequence := make(backends, 0, total)
+	for len(sequence) < int(total) {
+		best := 0
+		for i := range current {
+			if current[i] += weights[i]; current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		sequence = append(sequence, b[best])
+	}
+	return sequence
 }
 
-func (b backends) gcd() int32 {
-	divisor := int32(-1)
+func (b backends) maxLoadWeight() int32 {
+	maxWeight := int32(1)
 	for _, backend := range b {
-		if divisor == -1 {
-			divisor = backend.weight
-		} else {
-			divisor = gcd(divisor, backend.weight)
+		if weight := backend.loadWeight(); weight > maxWeight {
+			maxWeight = weight
 		}
 	}
-	return divisor
+	return maxWeight
 }
 
+// nearest returns the count of the backends sorted by the distance which are
+// not farther than the first one plus the tolerance
+func (b backends) nearest() int {
+	if len(b) == 0 || b[0].rtt == registry.UnknownDistance {
+		return len(b)
+	}
+	count := 1
+	for count < len(b) && b[count].rtt <= b[0].rtt+nearestTolerance {
+		count++
+	}
+	return count
+}
+
+// maxScheduleLength of the smooth weighted round robin sequence
+const maxScheduleLength = 1 << 14
+
 func gcd(a, b int32) int32 {
 	for b != 0 {
 		a, b = b, a%b
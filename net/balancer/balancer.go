@@ -1,11 +1,14 @@
 package balancer
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -20,8 +23,36 @@ type BalancingStrategy int
 const (
 	RoundRobinStrategy BalancingStrategy = iota
 	WeightStrategy
+
+	// NearestStrategy prefers the backends with the least estimated round trip time
+	// by the network coordinates of the nodes. The local backend is the nearest one,
+	// the backends of the unknown distance are used after the measured ones.
+	NearestStrategy
+
+	// LeastConnectionsStrategy chooses the backend with the fewest concurrent requests
+	// relative to its weight, the requests are counted by IncConcurrentRequest
+	LeastConnectionsStrategy
+
+	// PowerOfTwoChoicesStrategy chooses the less loaded of the two random backends,
+	// it's cheaper than the least connections for the big upstreams
+	PowerOfTwoChoicesStrategy
+
+	// RingHashStrategy chooses the backend by the key on the consistent hash ring,
+	// so the same key lands on the same backend, see NextForKey
+	RingHashStrategy
+
+	// MaglevStrategy chooses the backend by the key in the Maglev lookup table,
+	// it's the faster alternative of the RingHashStrategy
+	MaglevStrategy
 )
 
+// nearestTolerance of the round trip time, the backends which are not farther
+// than the nearest one plus the tolerance are balanced by the round robin
+const nearestTolerance = 2 * time.Millisecond
+
+// defaultRefreshInterval of the services polling and of the coordinates refresh
+const defaultRefreshInterval = 5 * time.Second
+
 // Balancer implements functionality of the dynamic balancing of the backends
 type Balancer interface {
 	// Run balancer autolookup
@@ -33,6 +64,10 @@ type Balancer interface {
 	// Next returns new backend according to the strategy
 	Next(service string, maxRequestsByBackend int) (*Backend, error)
 
+	// NextForKey returns the backend of the key by the consistent hash strategies,
+	// the other strategies ignore the key
+	NextForKey(service, key string, maxRequestsByBackend int) (*Backend, error)
+
 	// Backends returns list of backends of the paticular service
 	Backends(service string) []*Backend
 
@@ -52,22 +87,84 @@ type balancer struct {
 	discovery registry.Discovery
 
 	localAddrs []string
+	datacenter string
+	locality   *Locality
+	outlier    OutlierDetection
+	detection  bool // Outlier detection is enabled
 	quit       chan bool
+
+	// Interval of the polling and of the coordinates refresh
+	refreshInterval time.Duration
+
+	// Outlier detectors and hash tables of the services, mx guards the updates
+	mx        sync.Mutex
+	detectors map[string]*outlierDetector
+	hashes    map[string]*lazyHash
+
+	// Active health checks by the service name
+	healthChecks map[string]*HealthCheck
+}
+
+// Option of the balancer
+type Option func(b *balancer)
+
+// WithLocalAddrs option defines the addresses of the local host,
+// the local backend is preferred over the other ones
+func WithLocalAddrs(localAddrs ...string) Option {
+	return func(b *balancer) {
+		b.localAddrs = localAddrs
+	}
+}
+
+// WithLocality option enables the datacenter failover by the locality policy
+func WithLocality(locality Locality) Option {
+	return func(b *balancer) {
+		b.locality = &locality
+	}
+}
+
+// WithOutlierDetection option enables the ejection of the failing backends by the policy,
+// the detection is disabled without the option or by the zero policy
+func WithOutlierDetection(outlier OutlierDetection) Option {
+	return func(b *balancer) {
+		b.outlier = outlier
+	}
 }
 
 // New returns new balancer interface
 func New(strategy BalancingStrategy, discovery registry.Discovery, localAddrs ...string) (_ Balancer, err error) {
-	if len(localAddrs) == 0 || localAddrs[0] == "" {
-		if localAddrs, err = listOfLocalAddresses(); err != nil {
+	return NewWithOptions(strategy, discovery, WithLocalAddrs(localAddrs...))
+}
+
+// NewWithOptions returns new balancer interface configured by the options
+func NewWithOptions(strategy BalancingStrategy, discovery registry.Discovery, opts ...Option) (_ Balancer, err error) {
+	blnc := &balancer{
+		strategy:        strategy,
+		discovery:       discovery,
+		quit:            make(chan bool),
+		refreshInterval: defaultRefreshInterval,
+		detectors:       map[string]*outlierDetector{},
+		hashes:          map[string]*lazyHash{},
+		healthChecks:    map[string]*HealthCheck{},
+	}
+	for _, opt := range opts {
+		opt(blnc)
+	}
+
+	if len(blnc.localAddrs) == 0 || blnc.localAddrs[0] == "" {
+		if blnc.localAddrs, err = listOfLocalAddresses(); err != nil {
 			return nil, err
 		}
 	}
-
-	blnc := &balancer{
-		strategy:   strategy,
-		discovery:  discovery,
-		localAddrs: localAddrs,
+	if dc, ok := discovery.(datacenterer); ok {
+		blnc.datacenter = dc.Datacenter()
+	}
+	if blnc.locality != nil {
+		blnc.locality.init(blnc.datacenter)
 	}
+	// The policy of the disabled detection limits the skipped backends
+	blnc.detection = blnc.outlier.enabled()
+	blnc.outlier.init()
 
 	upstreams := make(map[string]*upstream)
 	atomic.StorePointer(&blnc.upstreams, unsafe.Pointer(&upstreams))
@@ -81,6 +178,7 @@ func (b *balancer) Run() error {
 		return err
 	}
 	go b.supervisor()
+	b.runHealthChecks()
 	return nil
 }
 
@@ -111,10 +209,32 @@ func (b *balancer) Backends(service string) (arr []*Backend) {
 
 // Next returns new backend according to the strategy
 func (b *balancer) Next(service string, maxRequestsByBackend int) (*Backend, error) {
-	if b.strategy == WeightStrategy {
-		return b.nextWeight(service, maxRequestsByBackend)
+	return b.next(service, func(ups *upstream) *Backend {
+		switch b.strategy {
+		case WeightStrategy:
+			return ups.nextWeightBackend(maxRequestsByBackend)
+		case NearestStrategy:
+			return ups.nextNearestBackend(maxRequestsByBackend)
+		case LeastConnectionsStrategy:
+			return ups.nextLeastConnectionsBackend(maxRequestsByBackend)
+		case PowerOfTwoChoicesStrategy:
+			return ups.nextPowerOfTwoChoicesBackend(maxRequestsByBackend)
+		}
+		return ups.nextBackend(maxRequestsByBackend)
+	})
+}
+
+// NextForKey returns the backend of the key by the consistent hash strategies,
+// the other strategies ignore the key
+func (b *balancer) NextForKey(service, key string, maxRequestsByBackend int) (*Backend, error) {
+	switch b.strategy {
+	case RingHashStrategy, MaglevStrategy:
+	default:
+		return b.Next(service, maxRequestsByBackend)
 	}
-	return b.nextRoundRobin(service, maxRequestsByBackend)
+	return b.next(service, func(ups *upstream) *Backend {
+		return ups.nextBackendForKey(key, maxRequestsByBackend)
+	})
 }
 
 // Refresh current balancer state
@@ -128,21 +248,14 @@ func (b *balancer) Close() error {
 	return nil
 }
 
-func (b *balancer) nextRoundRobin(service string, maxRequestsByBackend int) (*Backend, error) {
-	upstream := b.getUpstreamByServiceName(service)
-	if upstream != nil {
-		return upstream.nextBackend(maxRequestsByBackend), nil
-	}
-	return nil, fmt.Errorf("Service '%s' not found", service)
-}
-
-func (b *balancer) nextWeight(service string, maxRequestsByBackend int) (*Backend, error) {
+// next returns the backend of the service chosen by the selector of the strategy
+func (b *balancer) next(service string, choose func(*upstream) *Backend) (*Backend, error) {
 	upstream := b.getUpstreamByServiceName(service)
 	if upstream == nil {
 		return nil, fmt.Errorf("Service '%s' not found", service)
 	}
 
-	if backend := upstream.nextWeightBackend(maxRequestsByBackend); backend != nil {
+	if backend := choose(upstream); backend != nil {
 		return backend, nil
 	}
 
@@ -156,28 +269,85 @@ func (b *balancer) getUpstreamByServiceName(service string) *upstream {
 }
 
 func (b *balancer) lookup() error {
-	var (
-		backendServices = map[string]backends{}
-		services, err   = b.discovery.Lookup(nil)
-	)
+	services, err := b.discovery.Lookup(b.filter())
 	if err != nil {
-		return err
+		// The services of the available datacenters are still usable
+		if _, ok := err.(*registry.PartialLookupError); !ok || len(services) == 0 {
+			return err
+		}
 	}
+	b.update(services)
+	return nil
+}
+
+// filter of the services, the failover requires the services of all datacenters
+func (b *balancer) filter() *registry.Filter {
+	if b.locality != nil {
+		return &registry.Filter{Datacenter: "all"}
+	}
+	return nil
+}
+
+// update the upstreams by the list of services
+func (b *balancer) update(services []registry.Service) {
+	backendServices := map[string]backends{}
+	distance := b.distance()
 
 	// Group backends by services
 	for _, service := range services {
-		if service.Status == registry.SERVICE_STATUS_PASSING || service.Status == registry.SERVICE_STATUS_UNDEFINED {
+		if service.Healthy() {
 			backendServices[service.Name] = append(backendServices[service.Name], &Backend{
 				weight:      int32(serverWeight(&service)),
 				hostaddress: service.Address,
 				address:     net.JoinHostPort(service.Address, strconv.Itoa(service.Port)),
+				datacenter:  service.Datacenter,
+				rtt:         distance(&service),
 			})
 		}
 	}
 
+	if b.locality != nil {
+		for key, backends := range backendServices {
+			backendServices[key] = b.locality.choose(backends)
+		}
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	for key, backends := range backendServices {
+		b.trackHealth(key, backends)
+	}
+	for key := range b.detectors {
+		if _, ok := backendServices[key]; !ok {
+			delete(b.detectors, key)
+		}
+	}
+	for key := range b.hashes {
+		if _, ok := backendServices[key]; !ok {
+			delete(b.hashes, key)
+		}
+	}
+
 	upstreams := map[string]*upstream{}
 
 	for key, backends := range backendServices {
+		if b.strategy == NearestStrategy {
+			// The local backend has zero distance, so it's the first one
+			// instead of the priority backend
+			sort.SliceStable(backends, func(i, j int) bool { return backends[i].rtt < backends[j].rtt })
+			upstreams[key] = &upstream{backends: backends, nearest: backends.nearest()}
+			continue
+		}
+
+		// The priority backend would break the stickiness of the keys
+		switch b.strategy {
+		case RingHashStrategy, MaglevStrategy:
+			sorted := sortedByAddress(backends)
+			upstreams[key] = &upstream{backends: backends, sorted: sorted, hash: b.hashTable(key, sorted)}
+			continue
+		}
+
 		var priorityBackend *Backend
 
 	loop:
@@ -193,47 +363,148 @@ func (b *balancer) lookup() error {
 		upstreams[key] = &upstream{
 			priorityBackend: priorityBackend,
 			backends:        backends,
-			gcd:             backends.gcd(),
-			maxWeight:       backends.maxWeight(),
+		}
+		if b.strategy == WeightStrategy {
+			upstreams[key].schedule = backends.schedule()
 		}
 	}
 
 	atomic.StorePointer(&b.upstreams, unsafe.Pointer(&upstreams))
+}
 
-	return nil
+// hashTable returns the hash table of the service backends, the table
+// is reused while the backends are the same, mx must be locked
+func (b *balancer) hashTable(service string, sorted backends) *lazyHash {
+	if table, ok := b.hashes[service]; ok && table.signature == hashSignature(sorted) {
+		return table
+	}
+	build := func(list backends) hashTable { return newMaglev(list) }
+	if b.strategy == RingHashStrategy {
+		build = func(list backends) hashTable { return newRingHash(list) }
+	}
+	table := newLazyHash(build, sorted)
+	b.hashes[service] = table
+	return table
+}
+
+// trackHealth passes the outlier detection state of the current backends
+// to the new backends of the same address, mx must be locked
+func (b *balancer) trackHealth(service string, list backends) {
+	detector, ok := b.detectors[service]
+	if !ok {
+		detector = &outlierDetector{policy: &b.outlier, enabled: b.detection, now: time.Now}
+		b.detectors[service] = detector
+	}
+	health := map[string]*backendHealth{}
+	if current := b.getUpstreamByServiceName(service); current != nil {
+		for _, backend := range current.backends {
+			health[backend.address] = backend.health
+		}
+	}
+	for _, backend := range list {
+		if backend.health = health[backend.address]; backend.health == nil {
+			backend.health = &backendHealth{detector: detector}
+		}
+	}
+	detector.setBackends(list)
+}
+
+// distance returns the function which estimates the round trip time to the service
+// if the nearest strategy is used, the distance is unknown for the remote datacenters
+func (b *balancer) distance() func(*registry.Service) time.Duration {
+	if b.strategy != NearestStrategy {
+		return func(*registry.Service) time.Duration { return 0 }
+	}
+	var (
+		local *registry.Coordinate
+		nodes map[string]*registry.Coordinate
+	)
+	if provider, ok := b.discovery.(registry.CoordinateProvider); ok {
+		local, nodes, _ = provider.Coordinates()
+	}
+	return func(service *registry.Service) time.Duration {
+		for _, addr := range b.localAddrs {
+			if addr == service.Address {
+				return 0
+			}
+		}
+		if b.datacenter != "" && service.Datacenter != "" && service.Datacenter != b.datacenter {
+			return registry.UnknownDistance
+		}
+		return local.DistanceTo(nodes[service.Node])
+	}
 }
 
 func (b *balancer) supervisor() {
-	tick := time.NewTicker(5 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tick := time.NewTicker(b.refreshInterval)
+	defer tick.Stop()
+
+	var (
+		services []registry.Service
+		ok       bool
+		updates  = b.watch(ctx)
+	)
 	for {
 		select {
 		case <-tick.C:
-			b.lookup()
+			// Polling is the fallback if the discovery can't be watched
+			if updates == nil {
+				b.lookup()
+				updates = b.watch(ctx)
+			} else if b.strategy == NearestStrategy && services != nil {
+				// The coordinates are changed without the catalogue changes,
+				// so only they are requested again for the services of the last event
+				b.update(services)
+			}
+		case services, ok = <-updates:
+			if !ok {
+				updates = nil
+				services = nil
+				continue
+			}
+			b.update(services)
 		case <-b.quit:
-			tick.Stop()
 			return
 		}
 	}
 }
 
+// watch the changes of the healthy services, returns nil if the discovery is not available
+func (b *balancer) watch(ctx context.Context) <-chan []registry.Service {
+	updates, err := b.discovery.Watch(ctx, b.filter())
+	if err != nil {
+		return nil
+	}
+	return updates
+}
+
 func serverWeight(s *registry.Service) int {
 	weight := 1
-	for _, tag := range s.Tags {
-		if strings.HasPrefix(tag, "SERVICE_WEIGHT=") {
-			if v, _ := strconv.ParseInt(strings.TrimPrefix(tag, "SERVICE_WEIGHT="), 10, 64); v != 0 {
-				weight = int(v)
-			}
-		}
+	if v, _ := strconv.ParseInt(serviceValue(s, "SERVICE_WEIGHT"), 10, 64); v != 0 {
+		weight = int(v)
 	}
 	weight *= 100
-	for _, tag := range s.Tags {
-		if strings.HasPrefix(tag, "CPU_USAGE=") {
-			if v, _ := strconv.ParseFloat(strings.TrimPrefix(tag, "CPU_USAGE="), 64); v != 0 {
-				if usage := int(math.Ceil(v / 4.0)); usage != 0 {
-					weight = weight / int(math.Ceil(v/4.0))
-				}
-			}
+	if v, _ := strconv.ParseFloat(serviceValue(s, "CPU_USAGE"), 64); v != 0 {
+		if usage := int(math.Ceil(v / 4.0)); usage != 0 {
+			weight = weight / usage
 		}
 	}
 	return weight
 }
+
+// serviceValue returns the value from the service meta,
+// the "NAME=value" tag is used if the meta has no such key
+func serviceValue(s *registry.Service, name string) (value string) {
+	if v, ok := s.Meta[name]; ok {
+		return v
+	}
+	for _, tag := range s.Tags {
+		if strings.HasPrefix(tag, name+"=") {
+			value = strings.TrimPrefix(tag, name+"=")
+		}
+	}
+	return value
+}
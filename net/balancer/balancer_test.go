@@ -0,0 +1,393 @@
+package balancer
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/trafficstars/registry"
+	"github.com/trafficstars/registry/memory"
+)
+
+func Test_BalancerLookup(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "10.0.0.2:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-3", Name: "api", Address: "10.0.0.3:80"})
+
+	b, err := New(RoundRobinStrategy, discovery, "127.0.0.1")
+	if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+		return
+	}
+	assert.Equal(t, 3, b.CountOfBackends("api"))
+
+	discovery.Fail("api-2")
+	discovery.Warn("api-3")
+	discovery.Add(registry.Service{ID: "api-4", Name: "api", Address: "10.0.0.4", Port: 80, Status: registry.SERVICE_STATUS_PASSING, Maintenance: true})
+	if assert.NoError(t, b.Refresh()) && assert.Equal(t, 1, b.CountOfBackends("api")) {
+		backend, err := b.Next("api", 0)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "10.0.0.1:80", backend.Address())
+		}
+	}
+
+	_, err = b.Next("unknown", 0)
+	assert.Error(t, err)
+}
+
+func Test_BalancerWatch(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+
+	b, err := New(RoundRobinStrategy, discovery, "127.0.0.1")
+	if !assert.NoError(t, err) || !assert.NoError(t, b.Run()) {
+		return
+	}
+	defer b.Close()
+
+	// The changes are applied without waiting for the refresh
+	discovery.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "10.0.0.2:80"})
+	assert.Eventually(t, func() bool { return b.CountOfBackends("api") == 2 }, time.Second, 10*time.Millisecond)
+
+	discovery.Fail("api-1")
+	assert.Eventually(t, func() bool { return b.CountOfBackends("api") == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func Test_ServerWeight(t *testing.T) {
+	tests := []struct {
+		service registry.Service
+		weight  int
+	}{
+		{service: registry.Service{}, weight: 100},
+		{service: registry.Service{Tags: []string{"SERVICE_WEIGHT=3"}}, weight: 300},
+		{service: registry.Service{Meta: map[string]string{"SERVICE_WEIGHT": "5"}}, weight: 500},
+		{
+			service: registry.Service{
+				Tags: []string{"SERVICE_WEIGHT=3", "CPU_USAGE=2"},
+				Meta: map[string]string{"SERVICE_WEIGHT": "5"},
+			},
+			weight: 500,
+		},
+		{service: registry.Service{Meta: map[string]string{"SERVICE_WEIGHT": "4", "CPU_USAGE": "8"}}, weight: 200},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.weight, serverWeight(&test.service))
+	}
+}
+
+func Test_BalancerLocality(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	discovery.Add(
+		registry.Service{ID: "api-2", Name: "api", Datacenter: "dc2", Address: "10.0.1.1", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+		registry.Service{ID: "api-3", Name: "api", Datacenter: "dc3", Address: "10.0.2.1", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+		registry.Service{ID: "api-4", Name: "api", Datacenter: "dc3", Address: "10.0.2.2", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+	)
+
+	datacenters := func(b Balancer) (dcl []string) {
+		for _, backend := range b.Backends("api") {
+			dcl = append(dcl, backend.Datacenter())
+		}
+		return dcl
+	}
+
+	b, err := NewWithOptions(RoundRobinStrategy, discovery, WithLocalAddrs("127.0.0.1"), WithLocality(Locality{Failover: []string{"dc3"}}))
+	if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+		return
+	}
+	assert.Equal(t, []string{"dc1"}, datacenters(b), "the local datacenter is preferred")
+
+	discovery.Fail("api-1")
+	if assert.NoError(t, b.Refresh()) {
+		assert.Equal(t, []string{"dc3", "dc3"}, datacenters(b), "the failover order is followed")
+	}
+
+	// The datacenters without enough backends are skipped
+	b, err = NewWithOptions(RoundRobinStrategy, discovery, WithLocalAddrs("127.0.0.1"), WithLocality(Locality{MinHealthy: 2}))
+	if assert.NoError(t, err) && assert.NoError(t, b.Refresh()) {
+		assert.Equal(t, []string{"dc3", "dc3"}, datacenters(b))
+	}
+	discovery.Fail("api-4")
+	if assert.NoError(t, b.Refresh()) {
+		assert.Equal(t, []string{"dc2"}, datacenters(b), "the first datacenter with backends is used at last")
+	}
+}
+
+// rankedDiscovery returns the services ordered by the rank of the datacenter
+// as Consul does for the remote datacenters
+type rankedDiscovery struct {
+	*memory.Discovery
+	rank []string
+}
+
+func (d *rankedDiscovery) Lookup(filter *registry.Filter) ([]registry.Service, error) {
+	services, err := d.Discovery.Lookup(filter)
+	rank := func(dc string) int {
+		for i, name := range d.rank {
+			if name == dc {
+				return i
+			}
+		}
+		return len(d.rank)
+	}
+	sort.SliceStable(services, func(i, j int) bool { return rank(services[i].Datacenter) < rank(services[j].Datacenter) })
+	return services, err
+}
+
+func (d *rankedDiscovery) Watch(ctx context.Context, filter *registry.Filter) (<-chan []registry.Service, error) {
+	return registry.WatchServices(ctx, filter, func(ctx context.Context, index uint64) ([]registry.Service, uint64, error) {
+		if index != 0 {
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+		}
+		services, err := d.Lookup(filter)
+		return services, index + 1, err
+	})
+}
+
+func Test_BalancerLocalityWatch(t *testing.T) {
+	discovery := &rankedDiscovery{Discovery: memory.NewDiscovery("dc1"), rank: []string{"dc1", "dc3", "dc2"}}
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	discovery.Add(
+		registry.Service{ID: "api-2", Name: "api", Datacenter: "dc2", Address: "10.0.1.1", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+		registry.Service{ID: "api-3", Name: "api", Datacenter: "dc3", Address: "10.0.2.1", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+	)
+
+	b, err := NewWithOptions(RoundRobinStrategy, discovery, WithLocalAddrs("127.0.0.1"), WithLocality(Locality{}))
+	if !assert.NoError(t, err) || !assert.NoError(t, b.Run()) {
+		return
+	}
+	defer b.Close()
+
+	datacenter := func() string {
+		if backends := b.Backends("api"); len(backends) == 1 {
+			return backends[0].Datacenter()
+		}
+		return ""
+	}
+	assert.Equal(t, "dc1", datacenter())
+
+	// The nearest remote datacenter is used by the watch, not the first one by the service ID
+	discovery.Fail("api-1")
+	assert.Eventually(t, func() bool { return datacenter() == "dc3" }, time.Second, 5*time.Millisecond)
+	assert.Never(t, func() bool { return datacenter() != "dc3" }, 50*time.Millisecond, 5*time.Millisecond)
+}
+
+func Test_BalancerNearest(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.SetLocalNode("node-0")
+	discovery.SetCoordinate("node-0", &registry.Coordinate{Vec: []float64{0, 0}})
+	discovery.SetCoordinate("node-1", &registry.Coordinate{Vec: []float64{0.001, 0}})
+	discovery.SetCoordinate("node-2", &registry.Coordinate{Vec: []float64{0.010, 0}})
+	discovery.Add(
+		registry.Service{ID: "api-1", Name: "api", Datacenter: "dc1", Node: "node-2", Address: "10.0.0.1", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+		registry.Service{ID: "api-2", Name: "api", Datacenter: "dc1", Node: "node-3", Address: "10.0.0.2", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+		registry.Service{ID: "api-3", Name: "api", Datacenter: "dc1", Node: "node-1", Address: "10.0.0.3", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+	)
+
+	addresses := func(b Balancer) (addrs []string) {
+		for _, backend := range b.Backends("api") {
+			addrs = append(addrs, backend.Address())
+		}
+		return addrs
+	}
+
+	b, err := New(NearestStrategy, discovery, "127.0.0.1")
+	if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+		return
+	}
+	assert.Equal(t, []string{"10.0.0.3:80", "10.0.0.1:80", "10.0.0.2:80"}, addresses(b), "the backends of the unknown distance are the last")
+	assert.Equal(t, time.Millisecond, b.Backends("api")[0].RTT())
+	for i := 0; i < 3; i++ {
+		backend, err := b.Next("api", 1)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "10.0.0.3:80", backend.Address())
+		}
+	}
+
+	// The busy nearest backend is replaced with the next closest one
+	b.Backends("api")[0].IncConcurrentRequest(1)
+	if backend, err := b.Next("api", 1); assert.NoError(t, err) {
+		assert.Equal(t, "10.0.0.1:80", backend.Address())
+	}
+
+	// The backends of the close distance are balanced by the round robin
+	discovery.SetCoordinate("node-2", &registry.Coordinate{Vec: []float64{0.002, 0}})
+	if assert.NoError(t, b.Refresh()) {
+		used := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			if backend, err := b.Next("api", 0); assert.NoError(t, err) {
+				used[backend.Address()] = true
+			}
+		}
+		assert.Equal(t, map[string]bool{"10.0.0.1:80": true, "10.0.0.3:80": true}, used)
+	}
+
+	// The local backend is the nearest one
+	b, err = New(NearestStrategy, discovery, "10.0.0.2")
+	if assert.NoError(t, err) && assert.NoError(t, b.Refresh()) {
+		assert.Equal(t, []string{"10.0.0.2:80", "10.0.0.3:80", "10.0.0.1:80"}, addresses(b))
+		assert.Equal(t, 3, b.CountOfBackends("api"))
+	}
+}
+
+// movingDiscovery counts the lookups of the services, its coordinates
+// are changed without the events of the catalogue
+type movingDiscovery struct {
+	*memory.Discovery
+
+	lookups int32
+	mx      sync.Mutex
+	nodes   map[string]*registry.Coordinate
+}
+
+func (d *movingDiscovery) Lookup(filter *registry.Filter) ([]registry.Service, error) {
+	atomic.AddInt32(&d.lookups, 1)
+	return d.Discovery.Lookup(filter)
+}
+
+func (d *movingDiscovery) Coordinates() (*registry.Coordinate, map[string]*registry.Coordinate, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	nodes := make(map[string]*registry.Coordinate, len(d.nodes))
+	for node, coord := range d.nodes {
+		nodes[node] = coord
+	}
+	return nodes["node-0"], nodes, nil
+}
+
+func (d *movingDiscovery) move(node string, coord *registry.Coordinate) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.nodes[node] = coord
+}
+
+func Test_BalancerNearestRefresh(t *testing.T) {
+	discovery := &movingDiscovery{
+		Discovery: memory.NewDiscovery("dc1"),
+		nodes: map[string]*registry.Coordinate{
+			"node-0": {Vec: []float64{0, 0}},
+			"node-1": {Vec: []float64{0.001, 0}},
+			"node-2": {Vec: []float64{0.010, 0}},
+		},
+	}
+	discovery.Add(
+		registry.Service{ID: "api-1", Name: "api", Datacenter: "dc1", Node: "node-1", Address: "10.0.0.1", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+		registry.Service{ID: "api-2", Name: "api", Datacenter: "dc1", Node: "node-2", Address: "10.0.0.2", Port: 80, Status: registry.SERVICE_STATUS_PASSING},
+	)
+
+	blnc, err := New(NearestStrategy, discovery, "127.0.0.1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	blnc.(*balancer).refreshInterval = 10 * time.Millisecond
+	if !assert.NoError(t, blnc.Run()) {
+		return
+	}
+	defer blnc.Close()
+
+	nearest := func() string {
+		if backends := blnc.Backends("api"); len(backends) > 0 {
+			return backends[0].Address()
+		}
+		return ""
+	}
+	assert.Equal(t, "10.0.0.1:80", nearest())
+	time.Sleep(50 * time.Millisecond) // The first event of the watch is handled
+
+	// The distance is refreshed by the coordinates while the services are watched
+	discovery.move("node-1", &registry.Coordinate{Vec: []float64{0.020, 0}})
+	assert.Eventually(t, func() bool { return nearest() == "10.0.0.2:80" }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&discovery.lookups), "the services are not requested again")
+}
+
+func Test_BalancerLeastConnections(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "10.0.0.2:80"})
+
+	for _, strategy := range []BalancingStrategy{LeastConnectionsStrategy, PowerOfTwoChoicesStrategy} {
+		b, err := New(strategy, discovery, "127.0.0.1")
+		if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+			return
+		}
+		// The backend stays busy while the request is in flight
+		first, err := b.Next("api", 0)
+		if assert.NoError(t, err) {
+			first.IncConcurrentRequest(1)
+			second, err := b.Next("api", 0)
+			if assert.NoError(t, err) {
+				assert.NotEqual(t, first.Address(), second.Address())
+			}
+			first.IncConcurrentRequest(-1)
+		}
+		_, err = b.Next("unknown", 0)
+		assert.Error(t, err)
+	}
+}
+
+func Test_BalancerNextForKey(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "cache-1", Name: "cache", Address: "10.0.0.1:80"})
+	discovery.Register(registry.ServiceOptions{ID: "cache-2", Name: "cache", Address: "10.0.0.2:80"})
+	discovery.Register(registry.ServiceOptions{ID: "cache-3", Name: "cache", Address: "10.0.0.3:80"})
+
+	for _, strategy := range []BalancingStrategy{RingHashStrategy, MaglevStrategy} {
+		// The local backend isn't preferred since the keys are sticky
+		b, err := New(strategy, discovery, "10.0.0.1")
+		if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+			return
+		}
+		assert.Equal(t, 3, b.CountOfBackends("cache"))
+
+		used := map[string]string{}
+		for i := 0; i < 100; i++ {
+			key := "key-" + strconv.Itoa(i)
+			backend, err := b.NextForKey("cache", key, 0)
+			if assert.NoError(t, err) {
+				used[key] = backend.Address()
+			}
+		}
+		assert.Len(t, uniqueValues(used), 3)
+
+		// The keys of the other backends stay in place when the backend leaves
+		discovery.Fail("cache-2")
+		if assert.NoError(t, b.Refresh()) {
+			for key, address := range used {
+				backend, err := b.NextForKey("cache", key, 0)
+				if assert.NoError(t, err) && address != "10.0.0.2:80" {
+					assert.Equal(t, address, backend.Address())
+				}
+			}
+		}
+		discovery.Pass("cache-2")
+
+		_, err = b.NextForKey("unknown", "key", 0)
+		assert.Error(t, err)
+	}
+
+	// The other strategies ignore the key
+	b, err := New(RoundRobinStrategy, discovery, "127.0.0.1")
+	if assert.NoError(t, err) && assert.NoError(t, b.Refresh()) {
+		first, _ := b.NextForKey("cache", "key", 0)
+		second, _ := b.NextForKey("cache", "key", 0)
+		assert.NotEqual(t, first.Address(), second.Address())
+	}
+}
+
+func uniqueValues(m map[string]string) map[string]bool {
+	values := map[string]bool{}
+	for _, value := range m {
+		values[value] = true
+	}
+	return values
+}
@@ -0,0 +1,181 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// ringHashPoints count of the ring points of the backend per 100 weight units
+	ringHashPoints = 160
+
+	// maglevTableSize is the prime size of the Maglev lookup table
+	maglevTableSize = 65537
+)
+
+// hashTable maps the hash of the key to the backend, the table refers to the backends
+// by the index in the list sorted by the address, so the table is valid for any list
+// of the same addresses and weights
+type hashTable interface {
+	// get returns the backend of the key hash from the sorted list, the busy backends
+	// are replaced with the next ones of the table
+	get(sorted backends, hash uint64, maxRequestsByBackend int) *Backend
+}
+
+// lazyHash builds the hash table on the first use, so the services without the keys
+// don't pay for it. The table is shared by the upstreams of the same backends
+// and isn't rebuilt until the addresses or the weights are changed.
+type lazyHash struct {
+	once      sync.Once
+	build     func(backends) hashTable
+	signature string // Addresses and weights of the sorted backends
+	table     hashTable
+}
+
+func newLazyHash(build func(backends) hashTable, sorted backends) *lazyHash {
+	return &lazyHash{build: build, signature: hashSignature(sorted)}
+}
+
+func (lazy *lazyHash) get(sorted backends, hash uint64, maxRequestsByBackend int) *Backend {
+	lazy.once.Do(func() { lazy.table = lazy.build(sorted) })
+	return lazy.table.get(sorted, hash, maxRequestsByBackend)
+}
+
+// hashSignature identifies the table of the sorted backends
+func hashSignature(sorted backends) string {
+	var signature strings.Builder
+	for _, backend := range sorted {
+		signature.WriteString(backend.address)
+		signature.WriteByte('=')
+		signature.WriteString(strconv.Itoa(int(backend.loadWeight())))
+		signature.WriteByte(';')
+	}
+	return signature.String()
+}
+
+// hashKey returns the hash of the key which is the same for all processes
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return mix(h.Sum64())
+}
+
+// mix the bits of the FNV hash which are poorly distributed for the similar keys (splitmix64 finalizer)
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	return h ^ h>>31
+}
+
+// sortedByAddress returns the copy of the backends sorted by the address,
+// so the table is the same in every process regardless of the lookup order
+func sortedByAddress(list backends) backends {
+	sorted := append(backends{}, list...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].address != sorted[j].address {
+			return sorted[i].address < sorted[j].address
+		}
+		return sorted[i].loadWeight() < sorted[j].loadWeight()
+	})
+	return sorted
+}
+
+type ringPoint struct {
+	hash  uint64
+	index int32 // Index of the backend in the sorted list
+}
+
+// ringHash places the backends on the hash ring by the count of points proportional
+// to the weight, the key is served by the first backend clockwise from the key hash.
+// Only the keys of the backend are moved when it joins or leaves the ring.
+type ringHash []ringPoint
+
+func newRingHash(list backends) ringHash {
+	var ring ringHash
+	for index, backend := range sortedByAddress(list) {
+		points := int(backend.loadWeight()) * ringHashPoints / 100
+		if points < 1 {
+			points = 1
+		}
+		for i := 0; i < points; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(backend.address + "#" + strconv.Itoa(i)), index: int32(index)})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func (ring ringHash) get(sorted backends, hash uint64, maxRequestsByBackend int) *Backend {
+	if len(ring) == 0 {
+		return nil
+	}
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	for i := 0; i < len(ring); i++ {
+		if backend := sorted[ring[(start+i)%len(ring)].index]; available(backend, maxRequestsByBackend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// maglev lookup table fills the entries by the permutations of the backends,
+// the backends fill the count of the entries proportional to the weight.
+// It's faster than the ring and the load is even, but a few keys of the other
+// backends are moved when the backend joins or leaves the table.
+type maglev []int32
+
+func newMaglev(list backends) maglev {
+	list = sortedByAddress(list)
+	if len(list) == 0 {
+		return nil
+	}
+	var (
+		table     = make(maglev, maglevTableSize)
+		filled    = make([]bool, maglevTableSize)
+		offsets   = make([]uint64, len(list))
+		skips     = make([]uint64, len(list))
+		next      = make([]uint64, len(list))
+		credits   = make([]int64, len(list))
+		maxWeight = int64(list.maxLoadWeight())
+	)
+	for i, backend := range list {
+		offsets[i] = hashKey(backend.address) % maglevTableSize
+		skips[i] = hashKey(backend.address+"#skip")%(maglevTableSize-1) + 1
+	}
+	for count := 0; ; {
+		for i, backend := range list {
+			// The backend of the max weight takes the entry every round
+			if credits[i] += int64(backend.loadWeight()); credits[i] < maxWeight {
+				continue
+			}
+			credits[i] -= maxWeight
+			entry := (offsets[i] + next[i]*skips[i]) % maglevTableSize
+			for filled[entry] {
+				next[i]++
+				entry = (offsets[i] + next[i]*skips[i]) % maglevTableSize
+			}
+			table[entry], filled[entry] = int32(i), true
+			next[i]++
+			if count++; count == maglevTableSize {
+				return table
+			}
+		}
+	}
+}
+
+func (table maglev) get(sorted backends, hash uint64, maxRequestsByBackend int) *Backend {
+	if len(table) == 0 {
+		return nil
+	}
+	for i := uint64(0); i < uint64(len(table)); i++ {
+		if backend := sorted[table[(hash+i)%uint64(len(table))]]; available(backend, maxRequestsByBackend) {
+			return backend
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package balancer
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testHashBackends(count int) backends {
+	list := make(backends, 0, count)
+	for i := 0; i < count; i++ {
+		list = append(list, &Backend{address: "10.0.0." + strconv.Itoa(i+1) + ":80", weight: 100})
+	}
+	return list
+}
+
+func Test_HashTable(t *testing.T) {
+	builders := map[string]func(backends) hashTable{
+		"ring":   func(list backends) hashTable { return newRingHash(list) },
+		"maglev": func(list backends) hashTable { return newMaglev(list) },
+	}
+	for name, build := range builders {
+		t.Run(name, func(t *testing.T) {
+			var (
+				list     = testHashBackends(5)
+				sorted   = sortedByAddress(list)
+				table    = build(list)
+				reversed = build(backends{list[4], list[3], list[2], list[1], list[0]})
+				keys     = 10000
+				before   = map[string]string{}
+				load     = map[string]int{}
+			)
+			for i := 0; i < keys; i++ {
+				key := "key-" + strconv.Itoa(i)
+				address := table.get(sorted, hashKey(key), 0).Address()
+				assert.Equal(t, address, reversed.get(sorted, hashKey(key), 0).Address(), "the table doesn't depend on the order of the backends")
+				before[key] = address
+				load[address]++
+			}
+			for _, backend := range list {
+				assert.InDelta(t, keys/5, load[backend.Address()], float64(keys)/5*0.25)
+			}
+
+			// Only the keys of the removed backend are moved (and a few more for Maglev)
+			table, sorted = build(backends{list[0], list[1], list[3], list[4]}), backends{list[0], list[1], list[3], list[4]}
+			moved := 0
+			for key, address := range before {
+				if newAddress := table.get(sorted, hashKey(key), 0).Address(); newAddress != address {
+					assert.NotEqual(t, list[2].Address(), newAddress)
+					moved++
+				}
+			}
+			assert.InDelta(t, load[list[2].Address()], moved, float64(keys)*0.02)
+
+			// The busy backend is replaced with the next one
+			hash := hashKey("busy")
+			busy := table.get(sorted, hash, 1)
+			busy.IncConcurrentRequest(1)
+			if next := table.get(sorted, hash, 1); assert.NotNil(t, next) {
+				assert.NotEqual(t, busy.Address(), next.Address())
+			}
+			busy.IncConcurrentRequest(-1)
+		})
+	}
+}
+
+func Test_HashTableWeight(t *testing.T) {
+	list := testHashBackends(2)
+	list[1].weight = 300
+	for _, table := range []hashTable{newRingHash(list), newMaglev(list)} {
+		load := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			load[table.get(list, hashKey("key-"+strconv.Itoa(i)), 0).Address()]++
+		}
+		assert.InDelta(t, 7500, load[list[1].Address()], 500)
+	}
+	assert.Nil(t, newRingHash(nil).get(nil, 1, 0))
+	assert.Nil(t, newMaglev(nil).get(nil, 1, 0))
+}
+
+func Test_LazyHash(t *testing.T) {
+	var (
+		list = testHashBackends(3)
+		b    = &balancer{strategy: MaglevStrategy, hashes: map[string]*lazyHash{}}
+	)
+	table := b.hashTable("cache", sortedByAddress(list))
+	assert.Nil(t, table.table, "the table is built on the first key")
+
+	// The same backends of the next update share the table
+	same := sortedByAddress(testHashBackends(3))
+	if assert.True(t, table == b.hashTable("cache", same)) {
+		backend := table.get(same, hashKey("key"), 0)
+		assert.NotNil(t, table.table)
+		assert.True(t, backend == same[0] || backend == same[1] || backend == same[2], "the backend of the current list")
+		assert.Equal(t, backend.Address(), table.get(sortedByAddress(list), hashKey("key"), 0).Address())
+	}
+
+	// The changed weight requires the new table
+	changed := testHashBackends(3)
+	changed[0].weight = 200
+	assert.False(t, table == b.hashTable("cache", sortedByAddress(changed)))
+}
+
+func Benchmark_NextBackendForKey(b *testing.B) {
+	for name, hash := range map[string]hashTable{
+		"ring":   newRingHash(testHashBackends(10)),
+		"maglev": newMaglev(testHashBackends(10)),
+	} {
+		ups := upstream{backends: testHashBackends(10), sorted: sortedByAddress(testHashBackends(10)), hash: hash}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_ = ups.nextBackendForKey("user:42", 0)
+				}
+			})
+		})
+	}
+}
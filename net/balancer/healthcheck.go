@@ -0,0 +1,216 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Defaults of the active health check
+const (
+	DefaultHealthCheckInterval = 5 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+	DefaultUnhealthyThreshold  = 2
+	DefaultHealthyThreshold    = 1
+)
+
+// HealthCheck of the backends of the service made by the balancer itself
+// between the discovery refreshes. The backends which fail the check are not
+// chosen by any strategy until they pass the check again.
+//
+// The check kind is defined by the one of HTTP, TCP or GRPC fields.
+type HealthCheck struct {
+	// HTTP path of the GET request, the 2xx and 3xx statuses are healthy
+	HTTP string
+
+	// TCP connection to the backend address is healthy
+	TCP bool
+
+	// GRPC health Check RPC of the GRPCService, the empty name checks the whole server
+	GRPC        bool
+	GRPCService string
+
+	// Interval between the checks, 5s by default
+	Interval time.Duration
+
+	// Timeout of the check, 2s by default
+	Timeout time.Duration
+
+	// UnhealthyThreshold count of the failed checks in a row which marks the backend unhealthy
+	UnhealthyThreshold int
+
+	// HealthyThreshold count of the passed checks in a row which marks the backend healthy again
+	HealthyThreshold int
+}
+
+func (c *HealthCheck) init() {
+	if c.Interval <= 0 {
+		c.Interval = DefaultHealthCheckInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultHealthCheckTimeout
+	}
+	if c.UnhealthyThreshold < 1 {
+		c.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	if c.HealthyThreshold < 1 {
+		c.HealthyThreshold = DefaultHealthyThreshold
+	}
+}
+
+// WithHealthCheck option enables the active health check of the backends of the service
+func WithHealthCheck(service string, check HealthCheck) Option {
+	return func(b *balancer) {
+		check.init()
+		b.healthChecks[service] = &check
+	}
+}
+
+// runHealthChecks starts the checks of every service
+func (b *balancer) runHealthChecks() {
+	for service, check := range b.healthChecks {
+		go b.healthCheck(service, check)
+	}
+}
+
+func (b *balancer) healthCheck(service string, check *HealthCheck) {
+	prober := &prober{check: check, conns: map[string]*grpc.ClientConn{}}
+	defer prober.close()
+
+	tick := time.NewTicker(check.Interval)
+	defer tick.Stop()
+
+	for {
+		if upstream := b.getUpstreamByServiceName(service); upstream != nil {
+			prober.probe(upstream.backends)
+		}
+		select {
+		case <-tick.C:
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// prober checks the backends of the one service
+type prober struct {
+	check *HealthCheck
+
+	// Connections of the gRPC checks by the backend address
+	mx    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// probe all backends concurrently and wait the results
+func (p *prober) probe(list backends) {
+	var (
+		wg    sync.WaitGroup
+		known = make(map[string]bool, len(list))
+	)
+	for _, backend := range list {
+		known[backend.address] = true
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), p.check.Timeout)
+			defer cancel()
+			backend.health.probe(p.healthy(ctx, backend.address), p.check)
+		}(backend)
+	}
+	wg.Wait()
+
+	// The connections of the gone backends are closed
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for address, conn := range p.conns {
+		if !known[address] {
+			conn.Close()
+			delete(p.conns, address)
+		}
+	}
+}
+
+func (p *prober) healthy(ctx context.Context, address string) bool {
+	switch {
+	case p.check.HTTP != "":
+		return p.healthyHTTP(ctx, address)
+	case p.check.GRPC:
+		return p.healthyGRPC(ctx, address)
+	default:
+		return p.healthyTCP(ctx, address)
+	}
+}
+
+func (p *prober) healthyTCP(ctx context.Context, address string) bool {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (p *prober) healthyHTTP(ctx context.Context, address string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+p.check.HTTP, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusBadRequest
+}
+
+func (p *prober) healthyGRPC(ctx context.Context, address string) bool {
+	p.mx.Lock()
+	conn, ok := p.conns[address]
+	if !ok {
+		var err error
+		if conn, err = grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials())); err != nil {
+			p.mx.Unlock()
+			return false
+		}
+		p.conns[address] = conn
+	}
+	p.mx.Unlock()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: p.check.GRPCService})
+	return err == nil && resp.Status == healthpb.HealthCheckResponse_SERVING
+}
+
+func (p *prober) close() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	for address, conn := range p.conns {
+		conn.Close()
+		delete(p.conns, address)
+	}
+}
+
+// probe result is counted by the thresholds of the check
+func (h *backendHealth) probe(healthy bool, check *HealthCheck) {
+	if h == nil {
+		return
+	}
+	if healthy {
+		atomic.StoreInt32(&h.probeFailures, 0)
+		if passed := atomic.AddInt32(&h.probeSuccesses, 1); int(passed) >= check.HealthyThreshold {
+			atomic.StoreInt32(&h.unhealthy, 0)
+		}
+		return
+	}
+	atomic.StoreInt32(&h.probeSuccesses, 0)
+	if failed := atomic.AddInt32(&h.probeFailures, 1); int(failed) >= check.UnhealthyThreshold {
+		atomic.StoreInt32(&h.unhealthy, 1)
+	}
+}
@@ -0,0 +1,111 @@
+package balancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/trafficstars/registry"
+	"github.com/trafficstars/registry/memory"
+)
+
+// runHealthCheck registers the backends of the addresses and runs the balancer with the check
+func runHealthCheck(t *testing.T, check HealthCheck, addresses ...string) Balancer {
+	discovery := memory.NewDiscovery("dc1")
+	for i, address := range addresses {
+		discovery.Register(registry.ServiceOptions{ID: "api-" + string(rune('1'+i)), Name: "api", Address: address})
+	}
+	check.Interval = 10 * time.Millisecond
+	b, err := NewWithOptions(RoundRobinStrategy, discovery, WithLocalAddrs("10.0.0.1"), WithHealthCheck("api", check))
+	if !assert.NoError(t, err) || !assert.NoError(t, b.Run()) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func backendHealthy(b Balancer, address string) bool {
+	for _, backend := range b.Backends("api") {
+		if backend.Address() == address {
+			return backend.Healthy()
+		}
+	}
+	return false
+}
+
+func Test_HealthCheckHTTP(t *testing.T) {
+	var status int32 = http.StatusOK
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer failing.Close()
+	passing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer passing.Close()
+
+	var (
+		failingAddr = strings.TrimPrefix(failing.URL, "http://")
+		passingAddr = strings.TrimPrefix(passing.URL, "http://")
+		b           = runHealthCheck(t, HealthCheck{HTTP: "/health"}, failingAddr, passingAddr)
+	)
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	assert.Eventually(t, func() bool { return !backendHealthy(b, failingAddr) }, time.Second, 5*time.Millisecond)
+	assert.True(t, backendHealthy(b, passingAddr))
+	for i := 0; i < 4; i++ {
+		if backend, err := b.Next("api", 0); assert.NoError(t, err) {
+			assert.Equal(t, passingAddr, backend.Address(), "the unhealthy backend is skipped")
+		}
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	assert.Eventually(t, func() bool { return backendHealthy(b, failingAddr) }, time.Second, 5*time.Millisecond)
+}
+
+func Test_HealthCheckTCP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	address := strings.TrimPrefix(server.URL, "http://")
+	b := runHealthCheck(t, HealthCheck{TCP: true, UnhealthyThreshold: 1}, address)
+	assert.Never(t, func() bool { return !backendHealthy(b, address) }, 50*time.Millisecond, 5*time.Millisecond)
+
+	server.Close()
+	assert.Eventually(t, func() bool { return !backendHealthy(b, address) }, time.Second, 5*time.Millisecond)
+	_, err := b.Next("api", 0)
+	assert.Error(t, err)
+}
+
+func Test_HealthCheckGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var (
+		server       = grpc.NewServer()
+		healthServer = health.NewServer()
+	)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	address := listener.Addr().String()
+	healthServer.SetServingStatus("api", healthpb.HealthCheckResponse_SERVING)
+	b := runHealthCheck(t, HealthCheck{GRPC: true, GRPCService: "api"}, address)
+	assert.Never(t, func() bool { return !backendHealthy(b, address) }, 50*time.Millisecond, 5*time.Millisecond)
+
+	healthServer.SetServingStatus("api", healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.Eventually(t, func() bool { return !backendHealthy(b, address) }, time.Second, 5*time.Millisecond)
+
+	healthServer.SetServingStatus("api", healthpb.HealthCheckResponse_SERVING)
+	assert.Eventually(t, func() bool { return backendHealthy(b, address) }, time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,60 @@
+package balancer
+
+// Locality policy of the datacenters
+//
+// The backends of the local datacenter are used while there are at least
+// MinHealthy of them, otherwise the next datacenter in the failover order
+// which has enough backends serves the service.
+type Locality struct {
+	// Datacenter is the local DC, by default it's the DC of the discovery
+	Datacenter string
+
+	// Failover order of the remote datacenters. The datacenters which are not
+	// in the list follow it in the order of the lookup, Consul returns them
+	// sorted by the estimated round trip time.
+	Failover []string
+
+	// MinHealthy count of the backends of the datacenter, 1 by default
+	MinHealthy int
+}
+
+// datacenterer is implemented by the discoveries which know their datacenter
+type datacenterer interface {
+	Datacenter() string
+}
+
+func (l *Locality) init(datacenter string) {
+	if len(l.Datacenter) == 0 {
+		l.Datacenter = datacenter
+	}
+	if l.MinHealthy < 1 {
+		l.MinHealthy = 1
+	}
+}
+
+// choose the backends of the first datacenter which has enough of them,
+// if there is no such datacenter the first one which has any backends is used
+func (l *Locality) choose(list backends) backends {
+	var (
+		order        = append([]string{l.Datacenter}, l.Failover...)
+		byDatacenter = map[string]backends{}
+	)
+	for _, backend := range list {
+		if _, ok := byDatacenter[backend.datacenter]; !ok {
+			order = append(order, backend.datacenter)
+		}
+		byDatacenter[backend.datacenter] = append(byDatacenter[backend.datacenter], backend)
+	}
+
+	var fallback backends
+	for _, dc := range order {
+		backends := byDatacenter[dc]
+		if len(backends) >= l.MinHealthy {
+			return backends
+		}
+		if fallback == nil && len(backends) != 0 {
+			fallback = backends
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,244 @@
+package balancer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the outlier detection
+const (
+	DefaultConsecutiveFailures = 5
+	DefaultFailureRate         = 0.5
+	DefaultMinRequests         = 100
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 5 * time.Minute
+	DefaultMaxEjectionPercent  = 10
+)
+
+// skipEjectionTime of the backend skipped by Backend.Skip
+const skipEjectionTime = time.Second
+
+// DefaultOutlierDetection enables the outlier detection with the default policy
+var DefaultOutlierDetection = OutlierDetection{
+	ConsecutiveFailures: DefaultConsecutiveFailures,
+	FailureRate:         DefaultFailureRate,
+	MinRequests:         DefaultMinRequests,
+	BaseEjectionTime:    DefaultBaseEjectionTime,
+	MaxEjectionTime:     DefaultMaxEjectionTime,
+	MaxEjectionPercent:  DefaultMaxEjectionPercent,
+}
+
+// OutlierDetection policy ejects the backends which fail the requests reported
+// by Backend.Report, the ejected backends are not chosen by any strategy.
+//
+// The zero value disables the detection, then the backend of the failed request
+// is skipped for a second like by Backend.Skip. The ejection time grows exponentially
+// from BaseEjectionTime up to MaxEjectionTime with every next ejection of the backend.
+// The zero fields of the enabled policy are replaced with the defaults,
+// the negative values disable the particular check.
+type OutlierDetection struct {
+	// ConsecutiveFailures count which ejects the backend
+	ConsecutiveFailures int
+
+	// FailureRate of the MinRequests last requests which ejects the backend
+	FailureRate float64
+
+	// MinRequests count to calculate the failure rate
+	MinRequests int
+
+	// BaseEjectionTime of the first ejection
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionTime of the backend
+	MaxEjectionTime time.Duration
+
+	// MaxEjectionPercent of the backends of the service, one backend of the service
+	// which has two or more backends can be ejected regardless of the percent
+	MaxEjectionPercent int
+}
+
+// enabled returns false for the zero policy
+func (o *OutlierDetection) enabled() bool {
+	return *o != OutlierDetection{}
+}
+
+func (o *OutlierDetection) init() {
+	if o.ConsecutiveFailures == 0 {
+		o.ConsecutiveFailures = DefaultConsecutiveFailures
+	}
+	if o.FailureRate == 0 {
+		o.FailureRate = DefaultFailureRate
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = DefaultMinRequests
+	}
+	if o.BaseEjectionTime <= 0 {
+		o.BaseEjectionTime = DefaultBaseEjectionTime
+	}
+	if o.MaxEjectionTime <= 0 {
+		o.MaxEjectionTime = DefaultMaxEjectionTime
+	}
+	if o.MaxEjectionTime < o.BaseEjectionTime {
+		o.MaxEjectionTime = o.BaseEjectionTime
+	}
+	if o.MaxEjectionPercent == 0 {
+		o.MaxEjectionPercent = DefaultMaxEjectionPercent
+	}
+}
+
+// outlierDetector of the service, it lives across the updates of the upstream.
+// The skipped backends are ejected by the detector even if the detection is disabled.
+type outlierDetector struct {
+	policy   *OutlierDetection
+	enabled  bool
+	mx       sync.Mutex
+	backends backends
+	now      func() time.Time
+}
+
+func (d *outlierDetector) setBackends(list backends) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.backends = list
+}
+
+// eject the backend if the max ejection percent allows it
+func (d *outlierDetector) eject(health *backendHealth) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	now := d.now()
+	if !d.canEject(health, now) {
+		return
+	}
+
+	ejectionTime := d.policy.BaseEjectionTime
+	for i := atomic.AddInt32(&health.ejections, 1); i > 1 && ejectionTime < d.policy.MaxEjectionTime; i-- {
+		ejectionTime *= 2
+	}
+	if ejectionTime > d.policy.MaxEjectionTime {
+		ejectionTime = d.policy.MaxEjectionTime
+	}
+	atomic.StoreInt32(&health.consecutiveFailures, 0)
+	atomic.StoreInt64(&health.ejectedUntil, now.Add(ejectionTime).UnixNano())
+}
+
+// skip ejects the backend for the skipEjectionTime if the max ejection percent allows it,
+// the skip doesn't extend the next ejections of the backend
+func (d *outlierDetector) skip(health *backendHealth) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if now := d.now(); d.canEject(health, now) {
+		atomic.StoreInt64(&health.ejectedUntil, now.Add(skipEjectionTime).UnixNano())
+	}
+}
+
+// canEject returns true if the backend isn't ejected yet
+// and the max ejection percent allows it, mx must be locked
+func (d *outlierDetector) canEject(health *backendHealth, now time.Time) bool {
+	if health.ejected(now) {
+		return false
+	}
+	maxEjected := len(d.backends) * d.policy.MaxEjectionPercent / 100
+	if maxEjected < 1 && len(d.backends) > 1 {
+		maxEjected = 1
+	}
+	ejected := 0
+	for _, backend := range d.backends {
+		if backend.health.ejected(now) {
+			ejected++
+		}
+	}
+	return ejected < maxEjected
+}
+
+// backendHealth is the outlier detection state of the backend,
+// it's passed to the backend of the same address on the upstream update
+type backendHealth struct {
+	detector            *outlierDetector
+	consecutiveFailures int32
+	requests            int32
+	failures            int32
+	ejections           int32
+	ejectedUntil        int64 // Unix time in nanoseconds
+	latency             int64 // Moving average of the latency in nanoseconds
+
+	// State of the active health check
+	probeFailures  int32
+	probeSuccesses int32
+	unhealthy      int32
+}
+
+// isEjected checks the ejection time only if the backend has been ejected
+func (h *backendHealth) isEjected() bool {
+	if h == nil || atomic.LoadInt64(&h.ejectedUntil) == 0 {
+		return false
+	}
+	return h.ejected(h.detector.now())
+}
+
+func (h *backendHealth) ejected(now time.Time) bool {
+	if h == nil {
+		return false
+	}
+	until := atomic.LoadInt64(&h.ejectedUntil)
+	if until == 0 {
+		return false
+	}
+	if now.UnixNano() < until {
+		return true
+	}
+	atomic.CompareAndSwapInt64(&h.ejectedUntil, until, 0)
+	return false
+}
+
+func (h *backendHealth) report(success bool, latency time.Duration) {
+	for {
+		old := atomic.LoadInt64(&h.latency)
+		value := int64(latency)
+		if old != 0 {
+			value = old + (value-old)/8
+		}
+		if atomic.CompareAndSwapInt64(&h.latency, old, value) {
+			break
+		}
+	}
+
+	if h.detector == nil {
+		return
+	}
+	if !h.detector.enabled {
+		// The failed backend is skipped like by Backend.Skip
+		if !success {
+			h.detector.skip(h)
+		}
+		return
+	}
+	policy := h.detector.policy
+	eject := false
+
+	if success {
+		atomic.StoreInt32(&h.consecutiveFailures, 0)
+	} else {
+		atomic.AddInt32(&h.failures, 1)
+		failures := atomic.AddInt32(&h.consecutiveFailures, 1)
+		eject = policy.ConsecutiveFailures > 0 && int(failures) >= policy.ConsecutiveFailures
+	}
+
+	if requests := atomic.AddInt32(&h.requests, 1); int(requests) >= policy.MinRequests {
+		// The window is over, the next one is started
+		if atomic.CompareAndSwapInt32(&h.requests, requests, 0) {
+			failures := atomic.SwapInt32(&h.failures, 0)
+			if policy.FailureRate > 0 && float64(failures)/float64(requests) >= policy.FailureRate {
+				eject = true
+			} else if ejections := atomic.LoadInt32(&h.ejections); ejections > 0 {
+				// The healthy backend is ejected for the shorter time next time
+				atomic.CompareAndSwapInt32(&h.ejections, ejections, ejections-1)
+			}
+		}
+	}
+
+	if eject {
+		h.detector.eject(h)
+	}
+}
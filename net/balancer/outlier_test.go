@@ -0,0 +1,197 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/trafficstars/registry"
+	"github.com/trafficstars/registry/memory"
+)
+
+type testClock struct{ now time.Time }
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func testOutlierBackends(policy OutlierDetection, count int) (backends, *testClock) {
+	policy.init()
+	var (
+		clock    = &testClock{now: time.Unix(1e9, 0)}
+		detector = &outlierDetector{policy: &policy, enabled: true, now: clock.Now}
+		list     = testHashBackends(count)
+	)
+	for _, backend := range list {
+		backend.health = &backendHealth{detector: detector}
+	}
+	detector.setBackends(list)
+	return list, clock
+}
+
+func Test_OutlierConsecutiveFailures(t *testing.T) {
+	list, clock := testOutlierBackends(OutlierDetection{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    10 * time.Second,
+		MaxEjectionTime:     30 * time.Second,
+		MaxEjectionPercent:  50,
+	}, 4)
+	backend := list[0]
+
+	// The success resets the consecutive failures
+	backend.Report(false, time.Millisecond)
+	backend.Report(false, time.Millisecond)
+	backend.Report(true, time.Millisecond)
+	backend.Report(false, time.Millisecond)
+	backend.Report(false, time.Millisecond)
+	assert.False(t, backend.Ejected())
+	assert.Equal(t, time.Millisecond, backend.Latency())
+
+	// The ejection time grows exponentially up to the max
+	for _, ejectionTime := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		for !backend.Ejected() {
+			backend.Report(false, time.Millisecond)
+		}
+		clock.now = clock.now.Add(ejectionTime - time.Millisecond)
+		assert.True(t, backend.Ejected())
+		assert.False(t, available(backend, 0))
+		clock.now = clock.now.Add(time.Millisecond)
+		assert.False(t, backend.Ejected())
+	}
+}
+
+func Test_OutlierFailureRate(t *testing.T) {
+	list, _ := testOutlierBackends(OutlierDetection{
+		ConsecutiveFailures: -1,
+		FailureRate:         0.3,
+		MinRequests:         10,
+	}, 2)
+
+	// 2 of 10 requests failed
+	for i := 0; i < 10; i++ {
+		list[0].Report(i%5 != 0, 0)
+	}
+	assert.False(t, list[0].Ejected())
+
+	// 3 of 10 requests failed
+	for i := 0; i < 10; i++ {
+		list[0].Report(i%3 != 0, 0)
+	}
+	assert.True(t, list[0].Ejected())
+}
+
+func Test_OutlierMaxEjectionPercent(t *testing.T) {
+	list, _ := testOutlierBackends(OutlierDetection{ConsecutiveFailures: 1}, 3)
+	for _, backend := range list {
+		backend.Report(false, 0)
+	}
+	// 10% of the 3 backends is less than one backend, but one is ejected anyway
+	assert.True(t, list[0].Ejected())
+	assert.False(t, list[1].Ejected())
+	assert.False(t, list[2].Ejected())
+
+	// The only backend is never ejected
+	list, _ = testOutlierBackends(OutlierDetection{ConsecutiveFailures: 1}, 1)
+	list[0].Report(false, 0)
+	assert.False(t, list[0].Ejected())
+}
+
+func Test_BalancerOutlierDetection(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "10.0.0.2:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-3", Name: "api", Address: "10.0.0.3:80"})
+
+	strategies := []BalancingStrategy{
+		RoundRobinStrategy, WeightStrategy, NearestStrategy, LeastConnectionsStrategy,
+		PowerOfTwoChoicesStrategy, RingHashStrategy, MaglevStrategy,
+	}
+	for _, strategy := range strategies {
+		b, err := NewWithOptions(strategy, discovery, WithLocalAddrs("10.0.0.1"), WithOutlierDetection(OutlierDetection{ConsecutiveFailures: 2}))
+		if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+			return
+		}
+		var failing *Backend
+		for _, backend := range b.Backends("api") {
+			if backend.Address() == "10.0.0.1:80" {
+				failing = backend
+			}
+		}
+		failing.Report(false, 0)
+		failing.Report(false, 0)
+
+		// The ejection is kept after the refresh
+		if assert.NoError(t, b.Refresh()) {
+			for i := 0; i < 20; i++ {
+				backend, err := b.NextForKey("api", "key-"+string(rune('a'+i)), 0)
+				if assert.NoError(t, err, strategy) {
+					assert.NotEqual(t, "10.0.0.1:80", backend.Address(), strategy)
+				}
+			}
+		}
+	}
+}
+
+func Test_OutlierSkip(t *testing.T) {
+	list, clock := testOutlierBackends(OutlierDetection{}, 3)
+	list[0].Skip()
+	assert.True(t, list[0].Ejected())
+	assert.True(t, list[0].DoSkip())
+
+	// The skip respects the max ejection percent
+	list[1].Skip()
+	assert.False(t, list[1].Ejected())
+
+	clock.now = clock.now.Add(skipEjectionTime)
+	assert.False(t, list[0].Ejected())
+	assert.Zero(t, list[0].health.ejections, "the skip doesn't extend the next ejections")
+}
+
+func Test_BalancerOutlierDisabled(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "10.0.0.2:80"})
+
+	for _, opts := range [][]Option{nil, {WithOutlierDetection(OutlierDetection{})}} {
+		b, err := NewWithOptions(RoundRobinStrategy, discovery, append(opts, WithLocalAddrs("127.0.0.1"))...)
+		if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+			return
+		}
+		backend := b.Backends("api")[0]
+		for i := 0; i < 2*DefaultMinRequests; i++ {
+			backend.Report(false, time.Millisecond)
+		}
+		assert.True(t, backend.Ejected(), "the failed backend is skipped")
+		assert.Zero(t, backend.health.ejections, "the skip doesn't extend the ejection")
+		assert.WithinDuration(t, time.Now().Add(skipEjectionTime), time.Unix(0, backend.health.ejectedUntil), skipEjectionTime)
+		assert.Equal(t, time.Millisecond, backend.Latency(), "the latency is tracked anyway")
+	}
+}
+
+func Test_BalancerSkip(t *testing.T) {
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "10.0.0.2:80"})
+	discovery.Register(registry.ServiceOptions{ID: "api-3", Name: "api", Address: "10.0.0.3:80"})
+
+	strategies := []BalancingStrategy{
+		RoundRobinStrategy, WeightStrategy, NearestStrategy, LeastConnectionsStrategy,
+		PowerOfTwoChoicesStrategy, RingHashStrategy, MaglevStrategy,
+	}
+	for _, strategy := range strategies {
+		b, err := New(strategy, discovery, "10.0.0.1")
+		if !assert.NoError(t, err) || !assert.NoError(t, b.Refresh()) {
+			return
+		}
+		for _, backend := range b.Backends("api") {
+			if backend.Address() == "10.0.0.1:80" {
+				backend.Skip()
+			}
+		}
+		for i := 0; i < 20; i++ {
+			backend, err := b.NextForKey("api", "key-"+string(rune('a'+i)), 0)
+			if assert.NoError(t, err, strategy) {
+				assert.NotEqual(t, "10.0.0.1:80", backend.Address(), strategy)
+			}
+		}
+	}
+}
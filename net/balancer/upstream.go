@@ -1,29 +1,37 @@
 package balancer
 
-import "sync/atomic"
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
 
 type upstream struct {
 	// Current backend index
 	index uint32
 
-	// Balancing parameters
-	currentWeight int32
-	maxWeight     int32
-
 	// priority backend
 	priorityBackend *Backend
 
 	// List of the upstream backends
 	backends backends
 
-	// greatest common divisor
-	gcd int32
+	// Sequence of the backends by the smooth weighted round robin
+	schedule backends
+
+	// Count of the nearest backends, the backends are sorted by the distance
+	nearest int
+
+	// Consistent hash table of the backends
+	hash hashTable
+
+	// Backends sorted by the address for the hash table
+	sorted backends
 }
 
 func (ups *upstream) nextBackend(maxRequestsByBackend int) (back *Backend) {
 	// First send requests to the priority backend (generally this is the local service)
 	if ups.priorityBackend != nil {
-		if maxRequestsByBackend <= 0 || maxRequestsByBackend > ups.priorityBackend.ConcurrentRequestCount() {
+		if available(ups.priorityBackend, maxRequestsByBackend) {
 			return ups.priorityBackend
 		}
 	}
@@ -35,7 +43,7 @@ func (ups *upstream) nextBackend(maxRequestsByBackend int) (back *Backend) {
 		index := atomic.AddUint32(&ups.index, 1)
 		back = backends[index%backendCount]
 
-		if maxRequestsByBackend <= 0 || maxRequestsByBackend > back.ConcurrentRequestCount() {
+		if available(back, maxRequestsByBackend) {
 			return back
 		}
 	}
@@ -45,47 +53,109 @@ func (ups *upstream) nextBackend(maxRequestsByBackend int) (back *Backend) {
 func (ups *upstream) nextWeightBackend(maxRequestsByBackend int) *Backend {
 	// First send requests to the priority backend (generally this is the local service)
 	if ups.priorityBackend != nil {
-		if maxRequestsByBackend <= 0 || maxRequestsByBackend > ups.priorityBackend.ConcurrentRequestCount() {
+		if available(ups.priorityBackend, maxRequestsByBackend) {
 			return ups.priorityBackend
 		}
 	}
 
-	backends := ups.backends
-	backendCount := uint32(len(backends))
-	if backendCount < 1 {
-		return nil
-	}
+	// The schedule is immutable, so the concurrent calls just take the next entries of it
+	schedule := ups.schedule
+	scheduleLength := uint32(len(schedule))
 
-	for i := uint32(0); i < backendCount; i++ {
-		var (
-			currentWeight int32
-			index         = atomic.AddUint32(&ups.index, 1) % backendCount
-			backend       = backends[index]
-		)
+	for i := uint32(0); i < scheduleLength; i++ {
+		index := atomic.AddUint32(&ups.index, 1)
+		backend := schedule[index%scheduleLength]
 
-		if maxRequestsByBackend > backend.ConcurrentRequestCount() {
+		if !available(backend, maxRequestsByBackend) {
 			continue
 		}
+		return backend
+	}
+	return nil
+}
+
+func (ups *upstream) nextNearestBackend(maxRequestsByBackend int) *Backend {
+	backends := ups.backends
+	nearestCount := uint32(ups.nearest)
 
-		if index == 0 {
-			currentWeight = atomic.AddInt32(&ups.currentWeight, -ups.gcd)
-			if currentWeight <= 0 {
-				atomic.StoreInt32(&ups.currentWeight, ups.maxWeight)
-				if ups.maxWeight == 0 {
-					return backend
-				}
-				currentWeight = ups.maxWeight
-			}
-		} else {
-			currentWeight = atomic.LoadInt32(&ups.currentWeight)
+	// Balance the nearest backends by the round robin
+	for i := uint32(0); i < nearestCount; i++ {
+		index := atomic.AddUint32(&ups.index, 1)
+		back := backends[index%nearestCount]
+
+		if available(back, maxRequestsByBackend) {
+			return back
 		}
+	}
 
-		if int32(backend.weight) >= currentWeight {
-			if backend.DoSkip() {
-				continue
-			}
-			return backend
+	// The nearest backends are busy, so the closest of the rest is used
+	for _, back := range backends[nearestCount:] {
+		if available(back, maxRequestsByBackend) {
+			return back
 		}
 	}
 	return nil
 }
+
+func (ups *upstream) nextLeastConnectionsBackend(maxRequestsByBackend int) (back *Backend) {
+	// First send requests to the priority backend (generally this is the local service)
+	if ups.priorityBackend != nil {
+		if available(ups.priorityBackend, maxRequestsByBackend) {
+			return ups.priorityBackend
+		}
+	}
+
+	backends := ups.backends
+	backendCount := uint32(len(backends))
+
+	// The scan starts from the next backend every time, so the equally loaded backends are rotated
+	start := atomic.AddUint32(&ups.index, 1)
+	for i := uint32(0); i < backendCount; i++ {
+		candidate := backends[(start+i)%backendCount]
+		if !available(candidate, maxRequestsByBackend) {
+			continue
+		}
+		if back == nil || candidate.lessLoaded(back) {
+			back = candidate
+		}
+	}
+	return back
+}
+
+func (ups *upstream) nextPowerOfTwoChoicesBackend(maxRequestsByBackend int) *Backend {
+	// First send requests to the priority backend (generally this is the local service)
+	if ups.priorityBackend != nil {
+		if available(ups.priorityBackend, maxRequestsByBackend) {
+			return ups.priorityBackend
+		}
+	}
+
+	backends := ups.backends
+	backendCount := len(backends)
+	if backendCount < 2 {
+		return ups.nextLeastConnectionsBackend(maxRequestsByBackend)
+	}
+
+	first := rand.IntN(backendCount)
+	second := rand.IntN(backendCount - 1)
+	if second >= first {
+		second++
+	}
+	back := backends[first]
+	if backends[second].lessLoaded(back) {
+		back = backends[second]
+	}
+
+	if available(back, maxRequestsByBackend) {
+		return back
+	}
+	// Both choices are busy, so all backends are checked
+	return ups.nextLeastConnectionsBackend(maxRequestsByBackend)
+}
+
+func (ups *upstream) nextBackendForKey(key string, maxRequestsByBackend int) *Backend {
+	if ups.hash == nil {
+		return ups.nextBackend(maxRequestsByBackend)
+	}
+	return ups.hash.get(ups.sorted, hashKey(key), maxRequestsByBackend)
+}
@@ -1,6 +1,11 @@
 package balancer
 
-import "testing"
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 // goos: darwin
 // goarch: amd64
@@ -17,6 +22,7 @@ func Benchmark_NextBackend(b *testing.B) {
 			&Backend{address: "test3"},
 		},
 	}
+	ups.schedule = ups.backends.schedule()
 
 	b.ResetTimer()
 	b.ReportAllocs()
@@ -36,4 +42,177 @@ func Benchmark_NextBackend(b *testing.B) {
 			}
 		})
 	})
+
+	b.Run("nextLeastConnectionsBackend", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				back := ups.nextLeastConnectionsBackend(0)
+				back.IncConcurrentRequest(1)
+				back.IncConcurrentRequest(-1)
+			}
+		})
+	})
+
+	b.Run("nextPowerOfTwoChoicesBackend", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				back := ups.nextPowerOfTwoChoicesBackend(0)
+				back.IncConcurrentRequest(1)
+				back.IncConcurrentRequest(-1)
+			}
+		})
+	})
+}
+
+func Test_NextLeastConnectionsBackend(t *testing.T) {
+	ups := upstream{
+		backends: backends{
+			&Backend{address: "test1", weight: 100},
+			&Backend{address: "test2", weight: 100},
+			&Backend{address: "test3", weight: 300},
+		},
+	}
+	ups.backends[0].IncConcurrentRequest(1)
+	ups.backends[1].IncConcurrentRequest(2)
+	ups.backends[2].IncConcurrentRequest(4)
+
+	// 5/300 requests per weight unit is less than 2/100
+	assert.Equal(t, "test3", ups.nextLeastConnectionsBackend(0).Address())
+	ups.backends[2].IncConcurrentRequest(2)
+	assert.Equal(t, "test1", ups.nextLeastConnectionsBackend(0).Address())
+	ups.backends[0].IncConcurrentRequest(2)
+	assert.Equal(t, "test3", ups.nextLeastConnectionsBackend(0).Address())
+	assert.Equal(t, "test2", ups.nextLeastConnectionsBackend(4).Address(), "the busy backends are skipped")
+	assert.Nil(t, ups.nextLeastConnectionsBackend(2))
+
+	// The equally loaded backends are rotated
+	used := map[string]bool{}
+	ups.backends[2].weight = 100
+	ups.backends[2].IncConcurrentRequest(-3)
+	ups.backends[1].IncConcurrentRequest(1)
+	for i := 0; i < 6; i++ {
+		used[ups.nextLeastConnectionsBackend(0).Address()] = true
+	}
+	assert.Equal(t, map[string]bool{"test1": true, "test2": true, "test3": true}, used)
+}
+
+func Test_NextPowerOfTwoChoicesBackend(t *testing.T) {
+	ups := upstream{
+		backends: backends{
+			&Backend{address: "test1", weight: 100},
+			&Backend{address: "test2", weight: 100},
+		},
+	}
+	ups.backends[0].IncConcurrentRequest(3)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "test2", ups.nextPowerOfTwoChoicesBackend(0).Address())
+	}
+	ups.backends[1].IncConcurrentRequest(5)
+	assert.Equal(t, "test1", ups.nextPowerOfTwoChoicesBackend(5).Address(), "the busy backend is skipped")
+	assert.Nil(t, ups.nextPowerOfTwoChoicesBackend(3))
+
+	// The load is spread over the backends
+	ups.backends = backends{
+		&Backend{address: "test1", weight: 100},
+		&Backend{address: "test2", weight: 100},
+		&Backend{address: "test3", weight: 200},
+	}
+	for i := 0; i < 400; i++ {
+		ups.nextPowerOfTwoChoicesBackend(0).IncConcurrentRequest(1)
+	}
+	assert.InDelta(t, 100, ups.backends[0].ConcurrentRequestCount(), 10)
+	assert.InDelta(t, 100, ups.backends[1].ConcurrentRequestCount(), 10)
+	assert.InDelta(t, 200, ups.backends[2].ConcurrentRequestCount(), 10)
+}
+
+func Test_NextWeightBackend(t *testing.T) {
+	ups := upstream{
+		backends: backends{
+			&Backend{address: "test1", weight: 100},
+			&Backend{address: "test2", weight: 200},
+			&Backend{address: "test3", weight: 500},
+		},
+	}
+	ups.schedule = ups.backends.schedule()
+	assert.Len(t, ups.schedule, 8)
+
+	// Every period of the schedule matches the weights, and the heaviest
+	// backend isn't picked more than twice in a row
+	var (
+		counts = map[string]int{}
+		window = map[string]int{}
+		serial = 0
+		last   string
+	)
+	for i := 1; i <= 8000; i++ {
+		address := ups.nextWeightBackend(0).Address()
+		counts[address]++
+		window[address]++
+		if address == last {
+			serial++
+		} else {
+			serial = 1
+		}
+		assert.LessOrEqual(t, serial, 2)
+		last = address
+		if i%8 == 0 {
+			assert.Equal(t, map[string]int{"test1": 1, "test2": 2, "test3": 5}, window)
+			window = map[string]int{}
+		}
+	}
+	assert.Equal(t, map[string]int{"test1": 1000, "test2": 2000, "test3": 5000}, counts)
+
+	// The concurrent calls share the schedule and always get the backend
+	var (
+		mx  sync.Mutex
+		wg  sync.WaitGroup
+		got = map[string]int{}
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				backend := ups.nextWeightBackend(0)
+				mx.Lock()
+				if assert.NotNil(t, backend) {
+					got[backend.Address()]++
+				}
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, map[string]int{"test1": 1000, "test2": 2000, "test3": 5000}, got)
+
+	// The busy backends are skipped
+	ups.backends[2].IncConcurrentRequest(1)
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, "test3", ups.nextWeightBackend(1).Address())
+	}
+	ups.backends[0].IncConcurrentRequest(1)
+	ups.backends[1].IncConcurrentRequest(1)
+	assert.Nil(t, ups.nextWeightBackend(1))
+}
+
+func Test_WeightScheduleDistribution(t *testing.T) {
+	// The coprime weights produce the long schedule which is scaled down
+	list := backends{
+		&Backend{address: "test1", weight: 9973},
+		&Backend{address: "test2", weight: 19997},
+		&Backend{address: "test3", weight: 29989},
+	}
+	schedule := list.schedule()
+	assert.LessOrEqual(t, len(schedule), maxScheduleLength)
+
+	counts := map[string]int{}
+	for _, backend := range schedule {
+		counts[backend.Address()]++
+	}
+	total := float64(len(schedule))
+	for _, backend := range list {
+		expected := float64(backend.weight) / (9973 + 19997 + 29989)
+		assert.InDelta(t, expected, float64(counts[backend.Address()])/total, 0.001, backend.Address())
+	}
+	assert.Nil(t, backends{}.schedule())
 }
@@ -2,10 +2,14 @@ package grpc
 
 import (
 	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	netbalancer "github.com/trafficstars/registry/net/balancer"
 )
@@ -42,6 +46,7 @@ func (*registryPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
 				picker.serviceName = meta.serviceName
 				picker.servicePort = meta.servicePort
 				picker.maxRequestsByBackend = meta.maxRequestsByBackend
+				picker.keyHeader = meta.keyHeader
 			}
 			picker.subConns[scInfo.Address.Addr] = sc
 		}
@@ -59,20 +64,25 @@ type registryPicker struct {
 	subConns             map[string]balancer.SubConn
 	subConnList          []balancer.SubConn
 	maxRequestsByBackend int
+	keyHeader            string
 }
 
 func (p *registryPicker) Pick(opts balancer.PickInfo) (balancer.PickResult, error) {
 	if p.balancer != nil {
-		if backend, err := p.balancer.Next(p.serviceName, p.maxRequestsByBackend); err == nil {
+		if backend, err := p.nextBackend(opts); err == nil {
 			address := backend.Address()
 			if p.servicePort != "" {
 				address = backend.Hostname() + ":" + p.servicePort
 			}
 			if conn, ok := p.subConns[address]; ok {
 				backend.IncConcurrentRequest(1)
+				start := time.Now()
 				return balancer.PickResult{
 					SubConn: conn,
-					Done:    func(balancer.DoneInfo) { backend.IncConcurrentRequest(-1) },
+					Done: func(info balancer.DoneInfo) {
+						backend.IncConcurrentRequest(-1)
+						backend.Report(!failed(info.Err), time.Since(start))
+					},
 				}, nil
 			}
 		}
@@ -85,6 +95,26 @@ func (p *registryPicker) Pick(opts balancer.PickInfo) (balancer.PickResult, erro
 	}, nil
 }
 
+// nextBackend of the service, the requests of the same key are sent to the same backend
+func (p *registryPicker) nextBackend(opts balancer.PickInfo) (*netbalancer.Backend, error) {
+	if p.keyHeader != "" {
+		md, _ := metadata.FromOutgoingContext(opts.Ctx)
+		if keys := md.Get(p.keyHeader); len(keys) != 0 && keys[0] != "" {
+			return p.balancer.NextForKey(p.serviceName, keys[0], p.maxRequestsByBackend)
+		}
+	}
+	return p.balancer.Next(p.serviceName, p.maxRequestsByBackend)
+}
+
+// failed returns true if the error of the call means the backend failure
+func failed(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
 type simplePicker struct {
 	subConn balancer.SubConn
 }
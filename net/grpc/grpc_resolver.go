@@ -2,10 +2,14 @@ package grpc
 
 import (
 	"context"
+	"net"
+	"reflect"
+	"strconv"
 	"time"
 
 	"google.golang.org/grpc/resolver"
 
+	"github.com/trafficstars/registry"
 	net_balancer "github.com/trafficstars/registry/net/balancer"
 )
 
@@ -17,6 +21,7 @@ type grpcMetadata struct {
 	backend              *net_balancer.Backend
 	balancer             net_balancer.Balancer
 	maxRequestsByBackend int
+	keyHeader            string
 }
 
 type grpcResolver struct {
@@ -32,6 +37,12 @@ type grpcResolver struct {
 	// Default connection balancer
 	balancer net_balancer.Balancer
 
+	// Service discovery to watch the changes of the service instances
+	discovery registry.Discovery
+
+	// Metadata header with the key of the consistent hash balancing
+	keyHeader string
+
 	// Refresh timer interval
 	freq time.Duration
 
@@ -39,7 +50,8 @@ type grpcResolver struct {
 	cancel context.CancelFunc
 	cc     resolver.ClientConn
 
-	t *time.Ticker
+	// Addresses passed to the connection last time
+	addresses []string
 }
 
 // ResolveNow invoke an immediate resolution of the target that this dnsResolver watches.
@@ -48,23 +60,81 @@ func (r *grpcResolver) ResolveNow(opt resolver.ResolveNowOptions) {}
 // Close closes the dnsResolver.
 func (r *grpcResolver) Close() {
 	r.cancel()
-	if r.t != nil {
-		r.t.Stop()
-	}
 }
 
 func (r *grpcResolver) watcher() {
-	r.t = time.NewTicker(r.freq)
+	ticker := time.NewTicker(r.freq)
+	defer ticker.Stop()
+	var (
+		services []registry.Service
+		ok       bool
+		updates  = r.watch()
+	)
 	for {
 		select {
-		case <-r.t.C:
+		case <-ticker.C:
+			if updates == nil {
+				// Polling of the balancer is the fallback if the discovery can't be watched
+				r.refreshConnection()
+				updates = r.watch()
+			} else {
+				// The balancer can fail over to the other datacenters after the last event of the watch
+				r.updateConnection(services)
+			}
+		case services, ok = <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			r.updateConnection(services)
 		case <-r.ctx.Done():
 			return
 		}
-		r.refreshConnection()
 	}
 }
 
+// watch the healthy instances of the service, returns nil if the discovery is not available
+func (r *grpcResolver) watch() <-chan []registry.Service {
+	if r.discovery == nil {
+		return nil
+	}
+	updates, err := r.discovery.Watch(r.ctx, &registry.Filter{Service: r.serviceName})
+	if err != nil {
+		return nil
+	}
+	return updates
+}
+
+// updateConnection by the list of the service instances, the backends
+// of the balancer are kept too since it can fail over to the other datacenters
+func (r *grpcResolver) updateConnection(services []registry.Service) {
+	var (
+		addressList = make([]resolver.Address, 0, len(services))
+		known       = map[string]bool{}
+	)
+	for _, srv := range services {
+		address := net.JoinHostPort(srv.Address, strconv.Itoa(srv.Port))
+		if r.servicePort != "" {
+			address = srv.Address + ":" + r.servicePort
+		}
+		known[address] = true
+		addressList = append(addressList, r.address(address, nil))
+	}
+	if r.balancer != nil {
+		for _, backend := range r.balancer.Backends(r.serviceName) {
+			address := backend.Address()
+			if r.servicePort != "" {
+				address = backend.Hostname() + ":" + r.servicePort
+			}
+			if !known[address] {
+				known[address] = true
+				addressList = append(addressList, r.address(address, backend))
+			}
+		}
+	}
+	r.newAddress(addressList)
+}
+
 func (r *grpcResolver) refreshConnection() {
 	var (
 		service     = r.serviceName
@@ -81,19 +151,41 @@ func (r *grpcResolver) refreshConnection() {
 		if r.servicePort != "" {
 			address = backend.Hostname() + ":" + r.servicePort
 		}
-		addressList = append(addressList, resolver.Address{
-			Addr: address,
-			Metadata: &grpcMetadata{
-				serviceName:          service,
-				servicePort:          r.servicePort,
-				backend:              backend,
-				balancer:             balancer,
-				maxRequestsByBackend: r.maxRequestsByBackend,
-			},
-		})
+		addressList = append(addressList, r.address(address, backend))
 	}
 
+	r.newAddress(addressList)
+}
+
+// newAddress passes the list to the connection if the addresses are changed
+func (r *grpcResolver) newAddress(addressList []resolver.Address) {
+	addresses := make([]string, 0, len(addressList))
+	for _, address := range addressList {
+		addresses = append(addresses, address.Addr)
+	}
+	if r.addresses != nil && reflect.DeepEqual(r.addresses, addresses) {
+		return
+	}
+	r.addresses = addresses
 	r.cc.NewAddress(addressList)
 }
 
+func (r *grpcResolver) address(address string, backend *net_balancer.Backend) resolver.Address {
+	balancer := r.balancer
+	if balancer == nil {
+		balancer = net_balancer.Default()
+	}
+	return resolver.Address{
+		Addr: address,
+		Metadata: &grpcMetadata{
+			serviceName:          r.serviceName,
+			servicePort:          r.servicePort,
+			backend:              backend,
+			balancer:             balancer,
+			maxRequestsByBackend: r.maxRequestsByBackend,
+			keyHeader:            r.keyHeader,
+		},
+	}
+}
+
 var _ resolver.Resolver = (*grpcResolver)(nil)
@@ -0,0 +1,80 @@
+package grpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/resolver"
+
+	"github.com/trafficstars/registry"
+	"github.com/trafficstars/registry/memory"
+	net_balancer "github.com/trafficstars/registry/net/balancer"
+)
+
+type testClientConn struct {
+	resolver.ClientConn
+
+	mx        sync.Mutex
+	addresses []string
+}
+
+func (c *testClientConn) NewAddress(addressList []resolver.Address) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.addresses = c.addresses[:0]
+	for _, address := range addressList {
+		c.addresses = append(c.addresses, address.Addr)
+	}
+}
+
+func (c *testClientConn) Addresses() []string {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return append([]string(nil), c.addresses...)
+}
+
+func Test_ResolverBalancerFailover(t *testing.T) {
+	var (
+		local    = memory.NewDiscovery("dc1")
+		failover = memory.NewDiscovery("dc1")
+	)
+	local.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+	failover.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: "10.0.0.1:80"})
+
+	// The balancer has its own view of the service like after the failover to the other datacenter
+	balancer, err := net_balancer.New(net_balancer.RoundRobinStrategy, failover, "127.0.0.1")
+	if !assert.NoError(t, err) || !assert.NoError(t, balancer.Refresh()) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		cc     = &testClientConn{}
+		resolv = &grpcResolver{
+			serviceName: "api",
+			balancer:    balancer,
+			discovery:   local,
+			freq:        10 * time.Millisecond,
+			ctx:         ctx,
+			cancel:      cancel,
+			cc:          cc,
+		}
+	)
+	go resolv.watcher()
+	defer resolv.Close()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"10.0.0.1:80"}, cc.Addresses())
+	}, time.Second, 10*time.Millisecond)
+
+	failover.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: "10.0.1.1:80"})
+	if !assert.NoError(t, balancer.Refresh()) {
+		return
+	}
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"10.0.0.1:80", "10.0.1.1:80"}, cc.Addresses())
+	}, time.Second, 10*time.Millisecond, "the backends of the balancer are passed without the event of the watch")
+}
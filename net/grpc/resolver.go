@@ -3,6 +3,7 @@ package grpc
 import (
 	"context"
 	"net"
+	"strings"
 	"time"
 
 	"google.golang.org/grpc/resolver"
@@ -21,6 +22,14 @@ func WithBalancer(balancer balancer.Balancer) BuilderOption {
 	}
 }
 
+// WithKeyHeader option defines the request metadata header with the key
+// of the consistent hash balancing
+func WithKeyHeader(header string) BuilderOption {
+	return func(b *builder) {
+		b.keyHeader = strings.ToLower(header)
+	}
+}
+
 // WithRefreshInterval option
 func WithRefreshInterval(freq time.Duration) BuilderOption {
 	return func(b *builder) {
@@ -48,6 +57,7 @@ type builder struct {
 	freq      time.Duration
 	discovery registry.Discovery
 	balancer  balancer.Balancer
+	keyHeader string
 }
 
 // Build creates a new resolver for the given target.
@@ -76,6 +86,8 @@ func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts res
 		serviceName: host,
 		servicePort: port,
 		balancer:    b.balancer,
+		discovery:   b.discovery,
+		keyHeader:   b.keyHeader,
 		freq:        b.freq,
 		ctx:         ctx,
 		cancel:      cancel,
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	regbalancer "github.com/trafficstars/registry/net/balancer"
 )
@@ -32,6 +33,13 @@ func WithMaxRetry(maxRetry int) Option {
 	}
 }
 
+// WithKeyHeader option defines the request header with the key of the consistent hash balancing
+func WithKeyHeader(header string) Option {
+	return func(opt *Transport) {
+		opt.keyHeader = header
+	}
+}
+
 // DefaultMaxRetry count
 const DefaultMaxRetry = 2
 
@@ -43,6 +51,9 @@ type Transport struct {
 	// Max concurrent requests by backend
 	maxRequestsByBackend int
 
+	// Header with the key of the consistent hash balancing
+	keyHeader string
+
 	// Balancer default for this RoundTripper
 	balancer regbalancer.Balancer
 
@@ -83,22 +94,34 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		body, _ = ioutil.ReadAll(req.Body)
 	}
 	for i := 0; i <= t.maxRetry; i++ {
-		if backend, err = t.balancer.Next(service, t.maxRequestsByBackend); err == nil {
+		if backend, err = t.next(req, service); err == nil {
 			// Mark backend as performing a request
 			backend.IncConcurrentRequest(1)
 			defer backend.IncConcurrentRequest(-1)
 
 			req.URL.Host = backend.Address()
 			req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-			if response, err = t.httpTransport.RoundTrip(req); err == nil {
+			start := time.Now()
+			response, err = t.httpTransport.RoundTrip(req)
+
+			// The server errors are reported as failures for the outlier detection
+			backend.Report(err == nil && response.StatusCode < http.StatusInternalServerError, time.Since(start))
+			if err == nil {
 				return response, nil
 			}
-
-			// Skip next tries of requests to this backend
-			backend.Skip()
 		}
 	}
 	return nil, err
 }
 
+// next backend of the service, the requests of the same key are sent to the same backend
+func (t *Transport) next(req *http.Request, service string) (*regbalancer.Backend, error) {
+	if t.keyHeader != "" {
+		if key := req.Header.Get(t.keyHeader); key != "" {
+			return t.balancer.NextForKey(service, key, t.maxRequestsByBackend)
+		}
+	}
+	return t.balancer.Next(service, t.maxRequestsByBackend)
+}
+
 var _ http.RoundTripper = (*Transport)(nil)
@@ -0,0 +1,42 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/trafficstars/registry"
+	"github.com/trafficstars/registry/memory"
+	regbalancer "github.com/trafficstars/registry/net/balancer"
+)
+
+func Test_TransportSkipFailedBackend(t *testing.T) {
+	var failed int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failed, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	discovery := memory.NewDiscovery("dc1")
+	discovery.Register(registry.ServiceOptions{ID: "api-1", Name: "api", Address: failing.Listener.Addr().String()})
+	discovery.Register(registry.ServiceOptions{ID: "api-2", Name: "api", Address: healthy.Listener.Addr().String()})
+
+	// The outlier detection is disabled by the default options
+	balancer, err := regbalancer.New(regbalancer.RoundRobinStrategy, discovery, "127.0.0.1")
+	if !assert.NoError(t, err) || !assert.NoError(t, balancer.Refresh()) {
+		return
+	}
+	client := &http.Client{Transport: WrapHTTPTransport(&http.Transport{}, WithBalancer(balancer))}
+	for i := 0; i < 10; i++ {
+		if response, err := client.Get("http://api/"); assert.NoError(t, err) {
+			response.Body.Close()
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&failed), "the failed backend is skipped")
+}
@@ -1,10 +1,13 @@
 package registry
 
 import (
-	"github.com/hashicorp/consul/api"
-
+	"context"
+	"io"
 	"net/url"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,20 +24,25 @@ func New(dsn string, osArgs []string) (Registry, error) {
 	if err != nil {
 		return nil, err
 	}
-	client, err := api.NewClient(&api.Config{
-		Scheme:     url.Scheme,
-		Address:    url.Host,
-		Datacenter: url.Query().Get("dc"),
-		Token:      url.Query().Get("token"),
-	})
-	if err != nil {
-		return nil, err
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 	registry := registry{
-		client:          client,
 		datacenter:      url.Query().Get("dc"),
 		refreshInterval: 30 * time.Second,
 		bindChan:        make(chan struct{}),
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+	scheme := url.Scheme
+	if len(scheme) == 0 {
+		scheme = "consul" // Default local agent
+	}
+	driver, err := driver(scheme)
+	if err != nil {
+		return nil, err
+	}
+	if registry.kv, registry.discovery, err = driver(url); err != nil {
+		cancel()
+		return nil, err
 	}
 	if interval := url.Query().Get("refresh_interval"); len(interval) != 0 {
 		if v, err := strconv.ParseInt(interval, 10, 64); err == nil && v > 0 {
@@ -50,46 +58,102 @@ func New(dsn string, osArgs []string) (Registry, error) {
 }
 
 type registry struct {
-	client          *api.Client
+	kv              KV
+	discovery       Discovery
+	mx              sync.RWMutex
 	configs         []config
 	refreshInterval time.Duration
 	datacenter      string
 	bindChan        chan struct{}
+
+	// ctx of the supervisor, it's canceled by the Close
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (r *registry) KV() KV {
-	return &kv{client: r.client.KV()}
+	return r.kv
 }
 
 func (r *registry) Discovery() Discovery {
-	return &discovery{
-		agent:      r.client.Agent(),
-		health:     r.client.Health(),
-		catalog:    r.client.Catalog(),
-		datacenter: r.datacenter,
+	return r.discovery
+}
+
+// Close stops the watch of the registry keys and closes the KV
+// and the Discovery of the backend if they implement io.Closer
+func (r *registry) Close() error {
+	r.cancel()
+	var err error
+	for _, backend := range []interface{}{r.kv, r.discovery} {
+		if closer, ok := backend.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
 	}
+	return err
 }
 
 func (r *registry) supervisor() {
 	var (
-		refresh = time.Tick(r.refreshInterval)
+		refresh  = time.NewTicker(r.refreshInterval)
+		watched  = make(chan (<-chan KVEvent), 1)
+		watching = true
+		events   <-chan KVEvent
 	)
+	defer refresh.Stop()
+	// The initial fetch of the watch doesn't block the binding of the configs
+	go r.watch(watched)
 	for {
 		select {
-		case <-refresh:
-			r.Refresh()
+		case <-refresh.C:
+			// Polling is the fallback if the backend can't be watched
+			if events == nil && !watching {
+				r.Refresh()
+				watching = true
+				go r.watch(watched)
+			}
+		case events = <-watched:
+			watching = false
+			if events != nil {
+				// The keys could be changed or deleted while the watch was down
+				r.sync()
+			}
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			key := strings.TrimPrefix(event.Key, RegistryPrefix+"/")
+			switch event.Type {
+			case KV_EVENT_PUT:
+				r.update(map[string]string{key: event.Value})
+			case KV_EVENT_DELETE:
+				r.reset(key)
+			}
 		case <-r.bindChan:
 			r.Refresh()
+		case <-r.ctx.Done():
+			return
 		}
 	}
 }
 
+// watch the changes of the registry keys, sends nil if the backend is not available
+func (r *registry) watch(watched chan<- (<-chan KVEvent)) {
+	events, err := r.kv.WatchPrefix(r.ctx, RegistryPrefix+"/")
+	if err != nil {
+		events = nil
+	}
+	watched <- events
+}
+
 func (r *registry) Refresh() {
 	var (
 		kv   = r.KV()
 		keys []string
 	)
-	for _, config := range r.configs {
+	for _, config := range r.boundConfigs() {
 		for _, item := range config.items {
 			keys = append(keys, item.key)
 		}
@@ -100,7 +164,42 @@ func (r *registry) Refresh() {
 			values[key] = v
 		}
 	}
-	for _, config := range r.configs {
+	r.update(values)
+}
+
+// sync the bound configs with all registry keys, the fields
+// of the missing keys are reset
+func (r *registry) sync() {
+	list, err := r.kv.List(RegistryPrefix + "/")
+	if err != nil {
+		return
+	}
+	values := make(map[string]string, len(list))
+	for key, value := range list {
+		values[strings.TrimPrefix(key, RegistryPrefix+"/")] = value
+	}
+	var missing []string
+	for _, config := range r.boundConfigs() {
+		for _, item := range config.items {
+			if _, ok := values[item.key]; !ok {
+				missing = append(missing, item.key)
+			}
+		}
+	}
+	r.update(values)
+	r.reset(missing...)
+}
+
+// boundConfigs returns the configs bound so far
+func (r *registry) boundConfigs() []config {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.configs
+}
+
+// update the bound configs by the values of the registry keys
+func (r *registry) update(values map[string]string) {
+	for _, config := range r.boundConfigs() {
 		var updatedItemKeys []string
 
 		config.rawConfig.Lock()
@@ -120,3 +219,33 @@ func (r *registry) Refresh() {
 		config.callOnUpdatedMethod(updatedItemKeys) // Call method "OnUpdate<variableName>" if exists
 	}
 }
+
+// reset the fields bound to the deleted registry keys to the values
+// of their default, env and flag tags as if the keys were never set
+func (r *registry) reset(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	deleted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		deleted[key] = true
+	}
+	for _, config := range r.boundConfigs() {
+		var updatedItemKeys []string
+
+		config.rawConfig.Lock()
+		for _, item := range config.items {
+			if !deleted[item.key] {
+				continue
+			}
+			before := item.reference.Interface()
+			if item.reset(); reflect.DeepEqual(before, item.reference.Interface()) {
+				continue
+			}
+			updatedItemKeys = append(updatedItemKeys, item.path)
+		}
+		config.rawConfig.Unlock()
+
+		config.callOnUpdatedMethod(updatedItemKeys) // Call method "OnUpdate<variableName>" if exists
+	}
+}
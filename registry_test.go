@@ -0,0 +1,158 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stalledKV doesn't answer the initial fetch of the watch until it's released
+type stalledKV struct {
+	KV
+	release chan struct{}
+}
+
+func (kv *stalledKV) Get(string) (string, error) { return "", nil }
+
+func (kv *stalledKV) List(string) (map[string]string, error) { return nil, nil }
+
+func (kv *stalledKV) WatchPrefix(ctx context.Context, prefix string) (<-chan KVEvent, error) {
+	<-kv.release
+	return make(chan KVEvent), nil
+}
+
+func Test_SupervisorBind(t *testing.T) {
+	kv := &stalledKV{release: make(chan struct{})}
+	defer close(kv.release)
+	RegisterDriver("stalled", func(*url.URL) (KV, Discovery, error) { return kv, nil, nil })
+	defer func() {
+		driversMu.Lock()
+		delete(drivers, "stalled")
+		driversMu.Unlock()
+	}()
+
+	r, err := New("stalled://host", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	bound := make(chan error, 1)
+	go func() { bound <- r.Bind(&testWatchConfig{}) }()
+	select {
+	case err := <-bound:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the bind is blocked by the watch")
+	}
+}
+
+// unwatchedKV can't be watched until it's allowed, the keys are changed without the events
+type unwatchedKV struct {
+	KV
+	mx        sync.Mutex
+	values    map[string]string
+	watchable bool
+	attempts  int
+}
+
+func (kv *unwatchedKV) Get(key string) (string, error) {
+	kv.mx.Lock()
+	defer kv.mx.Unlock()
+	return kv.values[RegistryPrefix+"/"+key], nil
+}
+
+func (kv *unwatchedKV) List(prefix string) (map[string]string, error) {
+	kv.mx.Lock()
+	defer kv.mx.Unlock()
+	list := map[string]string{}
+	for key, value := range kv.values {
+		if strings.HasPrefix(key, prefix) {
+			list[key] = value
+		}
+	}
+	return list, nil
+}
+
+func (kv *unwatchedKV) WatchPrefix(ctx context.Context, prefix string) (<-chan KVEvent, error) {
+	kv.mx.Lock()
+	defer kv.mx.Unlock()
+	if kv.attempts++; !kv.watchable {
+		return nil, errors.New("watch is not available")
+	}
+	return make(chan KVEvent), nil
+}
+
+func Test_SupervisorRewatch(t *testing.T) {
+	kv := &unwatchedKV{values: map[string]string{RegistryPrefix + "/service/name": "changed"}}
+	RegisterDriver("unwatched", func(*url.URL) (KV, Discovery, error) { return kv, nil, nil })
+	defer func() {
+		driversMu.Lock()
+		delete(drivers, "unwatched")
+		driversMu.Unlock()
+	}()
+
+	r, err := New("unwatched://host?refresh_interval=1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	config := &testWatchConfig{}
+	if !assert.NoError(t, r.Bind(config)) {
+		return
+	}
+	assert.Equal(t, "changed", config.name())
+
+	// The key is deleted while the watch is down
+	assert.Eventually(t, func() bool {
+		kv.mx.Lock()
+		defer kv.mx.Unlock()
+		return kv.attempts != 0
+	}, time.Second, time.Millisecond)
+	kv.mx.Lock()
+	delete(kv.values, RegistryPrefix+"/service/name")
+	kv.watchable = true
+	kv.mx.Unlock()
+	assert.Eventually(t, func() bool { return config.name() == "default" }, 5*time.Second, 10*time.Millisecond,
+		"the deleted key is reset after the watch is restored")
+}
+
+func Test_RegistryClose(t *testing.T) {
+	_, address := runConsulFake(t)
+	r, err := New("http://"+address+"?refresh_interval=30", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The configs are bound while the events of the watch are applied
+	var wg sync.WaitGroup
+	configs := make([]*testWatchConfig, 5)
+	for i := range configs {
+		configs[i] = &testWatchConfig{}
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, r.KV().Set("service/name", "value-"+strconv.Itoa(i)))
+		}(i)
+		go func(config *testWatchConfig) {
+			defer wg.Done()
+			assert.NoError(t, r.Bind(config))
+		}(configs[i])
+	}
+	wg.Wait()
+	assert.NoError(t, r.KV().Set("service/name", "last"))
+	for _, config := range configs {
+		assert.Eventually(t, func() bool { return config.name() == "last" }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	assert.NoError(t, r.Close())
+	assert.NoError(t, r.KV().Set("service/name", "closed"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "last", configs[0].name(), "the closed registry doesn't watch the keys")
+	assert.NoError(t, r.Bind(&testWatchConfig{}), "the bind doesn't wait for the stopped supervisor")
+}
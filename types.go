@@ -1,6 +1,16 @@
 package registry
 
-import "sync"
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 const (
 	SERVICE_STATUS_UNDEFINED int8 = iota + 1
@@ -9,12 +19,20 @@ const (
 	SERVICE_STATUS_CRITICAL
 )
 
+const (
+	KV_EVENT_PUT int8 = iota + 1
+	KV_EVENT_DELETE
+)
+
 // Registry functionality definition
 type Registry interface {
 	KV() KV
 	Bind(i sync.Locker) error
 	Discovery() Discovery
 	Refresh()
+
+	// Close stops the watch of the registry keys and closes the backend
+	Close() error
 }
 
 // KV is key value storage functionality definition
@@ -23,6 +41,22 @@ type KV interface {
 	Set(key, value string) error
 	List(prefix string) (map[string]string, error)
 	Delete(string) error
+
+	// Watch streams the changes of the key until the context is done,
+	// the current value is sent as the first event
+	Watch(ctx context.Context, key string) (<-chan KVEvent, error)
+
+	// WatchPrefix streams the changes of all keys which start with the prefix
+	// until the context is done, the current values are sent as the first events
+	WatchPrefix(ctx context.Context, prefix string) (<-chan KVEvent, error)
+}
+
+// KVEvent describes the change of the key
+type KVEvent struct {
+	Type        int8 // KV_EVENT_PUT or KV_EVENT_DELETE
+	Key         string
+	Value       string
+	ModifyIndex uint64
 }
 
 // Descovery service functionality definition
@@ -30,6 +64,15 @@ type Discovery interface {
 	Lookup(*Filter) ([]Service, error)
 	Register(ServiceOptions) error
 	Deregister(string) error
+
+	// Watch streams the full set of the healthy services matched to the filter
+	// every time when the set is changed until the context is done
+	Watch(ctx context.Context, filter *Filter) (<-chan []Service, error)
+
+	// EnableMaintenance of the service instance, it's critical
+	// and excluded from the balancing until the maintenance is disabled
+	EnableMaintenance(serviceID, reason string) error
+	DisableMaintenance(serviceID string) error
 }
 
 // Service config definition
@@ -37,13 +80,37 @@ type Service struct {
 	ID         string
 	Name       string
 	Datacenter string
+	Node       string // Name of the node (host) of the instance if it's known
 	Address    string
 	Port       int
 	Tags       []string
+	Meta       map[string]string
 	Status     int8
+
+	// Maintenance is true if the instance or its node is in the maintenance mode
+	Maintenance bool
+
+	// Checks of the instance and of its node, the Status is the worst of them
+	Checks []CheckStatus
 }
 
-func (s *Service) test(filter *Filter) bool {
+// CheckStatus describes the state of the single health check
+type CheckStatus struct {
+	ID        string
+	Name      string
+	ServiceID string // Empty for the node checks
+	Status    int8
+	Output    string
+}
+
+// Healthy returns true if the status is passing or undefined (there are no checks)
+// and the instance is not in maintenance
+func (s *Service) Healthy() bool {
+	return !s.Maintenance && (s.Status == SERVICE_STATUS_PASSING || s.Status == SERVICE_STATUS_UNDEFINED)
+}
+
+// Match returns true if the service satisfies the filter
+func (s *Service) Match(filter *Filter) bool {
 	if filter == nil {
 		return true
 	}
@@ -59,12 +126,28 @@ func (s *Service) test(filter *Filter) bool {
 	if len(filter.Service) != 0 && filter.Service != s.Name {
 		return false
 	}
+	for key, value := range filter.Meta {
+		if v, ok := s.Meta[key]; !ok || v != value {
+			return false
+		}
+	}
+	if len(filter.Expression) != 0 && !s.matchExpression(filter.Expression) {
+		return false
+	}
+	for _, ft := range filter.AllTags {
+		if !containsTag(s.Tags, ft) {
+			return false
+		}
+	}
+	for _, ft := range filter.ExcludeTags {
+		if containsTag(s.Tags, ft) {
+			return false
+		}
+	}
 	if len(filter.Tags) != 0 {
 		for _, ft := range filter.Tags {
-			for _, st := range s.Tags {
-				if ft == st {
-					return true
-				}
+			if containsTag(s.Tags, ft) {
+				return true
 			}
 		}
 		return false
@@ -72,13 +155,62 @@ func (s *Service) test(filter *Filter) bool {
 	return true
 }
 
+// containsTag returns true if any tag matches the pattern,
+// the pattern can be the glob like "version=2.*"
+func containsTag(tags []string, pattern string) bool {
+	for _, tag := range tags {
+		if tag == pattern {
+			return true
+		}
+		if isTagGlob(pattern) {
+			if ok, _ := path.Match(pattern, tag); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isTagGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
 // Filter search descovery definition
+//
+// The tags can be defined by the glob patterns like "version=2.*"
 type Filter struct {
-	ID         string
-	Status     int8
-	Tags       []string
-	Service    string
-	Datacenter string
+	ID          string
+	Status      int8
+	Tags        []string          // Any tag has to match
+	AllTags     []string          // All tags have to match
+	ExcludeTags []string          // None of the tags has to match
+	Meta        map[string]string // All pairs have to be equal
+	Service     string
+	Datacenter  string
+
+	// Expression in the Consul filter syntax with the selectors of the catalog
+	// service endpoint: ServiceID, ServiceName, ServiceAddress, ServicePort,
+	// ServiceTags, ServiceMeta, Datacenter and Node, the other selectors
+	// are rejected by the Validate. For example:
+	//
+	//	ServiceMeta.version == "2" and "gpu" in ServiceTags
+	Expression string
+}
+
+// WithoutAllDatacenter prepares the filter for the backends which keep the instances
+// of all datacenters in the one storage. Such backend has nothing to fan out for
+// the "all" datacenter, so it just disables the datacenter check of the copy
+// of the filter. The nil filter is returned as the empty one.
+func (f *Filter) WithoutAllDatacenter() *Filter {
+	if f == nil {
+		return &Filter{}
+	}
+	if f.Datacenter != "all" {
+		return f
+	}
+	filter := *f
+	filter.Datacenter = ""
+	return &filter
 }
 
 // ServiceOptions defines proxy sevice object
@@ -87,15 +219,122 @@ type ServiceOptions struct {
 	Name    string
 	Address string
 	Tags    []string
-	Check   CheckOptions
+	Meta    map[string]string
+	Check   CheckOptions   // Single check, kept for the compatibility
+	Checks  []CheckOptions // Additional checks of the service
+}
+
+// HealthChecks returns the Check (if it's defined) followed by the Checks.
+// The default ID of the Check is the service ID and of the Checks is
+// "<service ID>:<number>" starting from 1, the empty names are filled too.
+func (o *ServiceOptions) HealthChecks() []CheckOptions {
+	var checks []CheckOptions
+	if o.Check.IsDefined() {
+		check := o.Check
+		if len(check.ID) == 0 {
+			check.ID = o.ID
+		}
+		if len(check.Name) == 0 {
+			check.Name = fmt.Sprintf("%s health status", o.Name)
+		}
+		checks = append(checks, check)
+	}
+	for i, check := range o.Checks {
+		if len(check.ID) == 0 {
+			check.ID = fmt.Sprintf("%s:%d", o.ID, i+1)
+		}
+		if len(check.Name) == 0 {
+			check.Name = fmt.Sprintf("%s health status %d", o.Name, i+1)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// SplitServiceAddress extracts the host and the port from the address of the ServiceOptions
+// which can be defined as "host", "host:port" or "http://host:port"
+func SplitServiceAddress(address string) (host string, port int, err error) {
+	host = address
+	if strings.HasPrefix(host, "http") {
+		url, err := url.Parse(host)
+		if err != nil {
+			return "", 0, err
+		}
+		host = url.Host
+	}
+	if strings.Contains(host, ":") {
+		h, p, err := net.SplitHostPort(host)
+		if err != nil {
+			return "", 0, err
+		}
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return "", 0, err
+		}
+		host = h
+		port = int(v)
+	}
+	return host, port, nil
 }
 
 // CheckOptions defines sevice healthcheck
+//
+// The kind of the check is defined by the first non empty field of
+// HTTP, TCP, GRPC, TTL, DockerContainerID or AliasService.
 type CheckOptions struct {
-	Interval        string
-	Timeout         string
-	HTTP            string
-	TCP             string
-	TTL             string
+	ID       string
+	Name     string
+	Interval string
+	Timeout  string
+
+	// HTTP check options
+	HTTP          string
+	Method        string
+	Header        map[string][]string
+	TLSSkipVerify bool
+
+	TCP string
+
+	// GRPC check of the "host:port/service" address
+	GRPC       string
+	GRPCUseTLS bool
+
+	// TTL check is passing only if it's updated in time by the service itself
+	TTL string
+
+	// Docker check runs the command inside of the container by the shell
+	DockerContainerID string
+	Shell             string
+	Args              []string
+
+	// Alias check mirrors the health of the other service
+	AliasService string
+	AliasNode    string
+
 	DeregisterAfter string
 }
+
+// IsDefined returns true if the kind of the check is defined
+func (c *CheckOptions) IsDefined() bool {
+	return c.HTTP != "" || c.TCP != "" || c.GRPC != "" || c.TTL != "" ||
+		c.DockerContainerID != "" || c.AliasService != ""
+}
+
+// PartialLookupError reports the datacenters which lookup is failed,
+// it's returned together with the services of the other datacenters
+type PartialLookupError struct {
+	Errors map[string]error // Datacenter => error
+}
+
+func (e *PartialLookupError) Error() string {
+	dcl := make([]string, 0, len(e.Errors))
+	for dc := range e.Errors {
+		dcl = append(dcl, dc)
+	}
+	sort.Strings(dcl)
+	messages := make([]string, 0, len(dcl))
+	for _, dc := range dcl {
+		messages = append(messages, fmt.Sprintf("datacenter %s lookup: %s", dc, e.Errors[dc]))
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,96 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ServiceMatch(t *testing.T) {
+	srv := Service{
+		ID:   "api-1",
+		Name: "api",
+		Tags: []string{"http", "version=2.1", "zone=a"},
+		Meta: map[string]string{"version": "2"},
+		Port: 8080,
+	}
+	tests := []struct {
+		filter Filter
+		match  bool
+	}{
+		{filter: Filter{}, match: true},
+		{filter: Filter{Tags: []string{"grpc", "http"}}, match: true},
+		{filter: Filter{Tags: []string{"grpc"}}, match: false},
+		{filter: Filter{Tags: []string{"version=2.*"}}, match: true},
+		{filter: Filter{Tags: []string{"version=1.*"}}, match: false},
+		{filter: Filter{AllTags: []string{"http", "zone=a"}}, match: true},
+		{filter: Filter{AllTags: []string{"http", "zone=b"}}, match: false},
+		{filter: Filter{AllTags: []string{"version=*", "zone=?"}}, match: true},
+		{filter: Filter{ExcludeTags: []string{"drain"}}, match: true},
+		{filter: Filter{ExcludeTags: []string{"drain", "zone=*"}}, match: false},
+		{filter: Filter{Tags: []string{"http"}, AllTags: []string{"zone=a"}, ExcludeTags: []string{"version=1.*"}}, match: true},
+		{filter: Filter{Tags: []string{"grpc"}, AllTags: []string{"zone=a"}}, match: false},
+		{filter: Filter{Expression: `ServiceMeta.version == "2" and "http" in ServiceTags`}, match: true},
+		{filter: Filter{Expression: `ServiceMeta.version == "1" or ServicePort != 8080`}, match: false},
+		{filter: Filter{Expression: `ServiceMeta.zone == "a"`}, match: false},
+		{filter: Filter{Expression: `ServiceName matches "^a"`}, match: true},
+		{filter: Filter{Expression: `ServiceName ==`}, match: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.match, srv.Match(&test.filter), "%+v", test.filter)
+	}
+}
+
+func Test_FilterValidate(t *testing.T) {
+	assert.NoError(t, (*Filter)(nil).Validate())
+	assert.NoError(t, (&Filter{Expression: `"gpu" in ServiceTags`}).Validate())
+	assert.Error(t, (&Filter{Expression: `"gpu" in`}).Validate())
+	assert.Error(t, (&Filter{Expression: `NodeMeta.rack == "a"`}).Validate(), "the selector of Consul which can't be evaluated")
+	assert.Error(t, (&Filter{Expression: `ServiceKind == ""`}).Validate())
+	assert.NoError(t, (&Filter{Expression: `ServiceMeta.rack == "a" and Node == "n1"`}).Validate())
+}
+
+func Test_FilterWithoutAllDatacenter(t *testing.T) {
+	assert.Equal(t, &Filter{}, (*Filter)(nil).WithoutAllDatacenter())
+
+	filter := &Filter{Service: "api", Datacenter: "all"}
+	assert.Equal(t, &Filter{Service: "api"}, filter.WithoutAllDatacenter())
+	assert.Equal(t, "all", filter.Datacenter, "the filter itself is kept")
+
+	filter = &Filter{Service: "api", Datacenter: "dc2"}
+	assert.Same(t, filter, filter.WithoutAllDatacenter())
+}
+
+func Test_HealthExpression(t *testing.T) {
+	tests := map[string]string{
+		`ServiceMeta.version == "2" and "gpu" in ServiceTags`: `Service.Meta.version == "2" and "gpu" in Service.Tags`,
+		`ServiceID != "ServiceID" or Node == "node-1"`:        `Service.ID != "ServiceID" or Node.Node == "node-1"`,
+		`ServiceMeta.Datacenter == "a \" ServiceName"`:        `Service.Meta.Datacenter == "a \" ServiceName"`,
+		"Datacenter matches `dc.*` and not ServicePort == 80": "Node.Datacenter matches `dc.*` and not Service.Port == 80",
+		`ServiceAddress is not empty and ServiceName != ""`:   `Service.Address is not empty and Service.Service != ""`,
+	}
+	for expression, expected := range tests {
+		assert.Equal(t, expected, healthExpression(expression))
+	}
+}
+
+func Test_SplitServiceAddress(t *testing.T) {
+	tests := map[string]struct {
+		host string
+		port int
+	}{
+		"10.0.0.1":             {host: "10.0.0.1"},
+		"10.0.0.1:8080":        {host: "10.0.0.1", port: 8080},
+		"http://10.0.0.1:8080": {host: "10.0.0.1", port: 8080},
+		"[::1]:80":             {host: "::1", port: 80},
+	}
+	for address, expected := range tests {
+		host, port, err := SplitServiceAddress(address)
+		if assert.NoError(t, err, address) {
+			assert.Equal(t, expected.host, host, address)
+			assert.Equal(t, expected.port, port, address)
+		}
+	}
+	_, _, err := SplitServiceAddress("10.0.0.1:port")
+	assert.Error(t, err)
+}
@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	watchMinRetryInterval = time.Second
+	watchMaxRetryInterval = time.Minute
+)
+
+// KVEntry is the value of the key with the index of its last modification
+type KVEntry struct {
+	Value       string
+	ModifyIndex uint64
+}
+
+// KVFetchFunc returns the state of the watched keys together with the index of the state.
+// If the index is not zero the call blocks until the state differs from the state with this index.
+type KVFetchFunc func(ctx context.Context, index uint64) (map[string]KVEntry, uint64, error)
+
+// WatchKV streams the difference between the subsequent states returned by the fetch
+// function as the events. It's intended for the KV implementations of the backends.
+//
+// The first fetch error is returned immediately, the next fetches are retried
+// with the exponential backoff until the context is done.
+func WatchKV(ctx context.Context, fetch KVFetchFunc) (<-chan KVEvent, error) {
+	entries, index, err := fetch(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan KVEvent)
+	go func() {
+		defer close(events)
+		state := map[string]KVEntry{}
+		for {
+			for _, event := range kvDiff(state, entries, index) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			state = entries
+
+			ok := retry(ctx, func() (err error) {
+				var newIndex uint64
+				if entries, newIndex, err = fetch(ctx, index); err == nil {
+					index = nextIndex(index, newIndex)
+				}
+				return err
+			})
+			if !ok {
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// kvDiff returns the events which convert the old state to the new one
+func kvDiff(old, new map[string]KVEntry, index uint64) []KVEvent {
+	var events []KVEvent
+	for key, entry := range new {
+		if prev, ok := old[key]; !ok || prev != entry {
+			events = append(events, KVEvent{Type: KV_EVENT_PUT, Key: key, Value: entry.Value, ModifyIndex: entry.ModifyIndex})
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			events = append(events, KVEvent{Type: KV_EVENT_DELETE, Key: key, ModifyIndex: index})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].ModifyIndex != events[j].ModifyIndex {
+			return events[i].ModifyIndex < events[j].ModifyIndex
+		}
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
+
+// ServicesFetchFunc returns the services together with the index of the catalogue state.
+// If the index is not zero the call blocks until the catalogue differs from the state with this index.
+type ServicesFetchFunc func(ctx context.Context, index uint64) ([]Service, uint64, error)
+
+// WatchServices streams the healthy services returned by the fetch function every time
+// when the set is changed. It's intended for the Discovery implementations of the backends.
+//
+// The services are healthy if the status is passing or undefined (there are no checks)
+// and the service is not in maintenance, unless the filter defines the status explicitly.
+// The order of the fetched services is kept (the datacenters of the Consul lookup
+// are sorted by the round trip time), so the fetch must return them in the stable order.
+// The first fetch error is returned immediately, the next fetches are retried
+// with the exponential backoff until the context is done.
+func WatchServices(ctx context.Context, filter *Filter, fetch ServicesFetchFunc) (<-chan []Service, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	services, index, err := fetch(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(chan []Service)
+	go func() {
+		defer close(updates)
+		var last []Service
+		for first := true; ; first = false {
+			if services = healthyServices(services, filter); first || !reflect.DeepEqual(last, services) {
+				select {
+				case updates <- services:
+				case <-ctx.Done():
+					return
+				}
+				last = services
+			}
+
+			ok := retry(ctx, func() (err error) {
+				var newIndex uint64
+				if services, newIndex, err = fetch(ctx, index); err == nil {
+					index = nextIndex(index, newIndex)
+				}
+				return err
+			})
+			if !ok {
+				return
+			}
+		}
+	}()
+	return updates, nil
+}
+
+func healthyServices(services []Service, filter *Filter) []Service {
+	result := make([]Service, 0, len(services))
+	for _, srv := range services {
+		if filter != nil && filter.Status != 0 || srv.Healthy() {
+			result = append(result, srv)
+		}
+	}
+	return result
+}
+
+// nextIndex returns the index for the next blocking query
+func nextIndex(index, newIndex uint64) uint64 {
+	if newIndex < index {
+		return 0 // The index went backwards, start from scratch
+	}
+	return newIndex
+}
+
+// retry calls the function with the exponential backoff until it succeeds,
+// returns false if the context is done
+func retry(ctx context.Context, fn func() error) bool {
+	for backoff := watchMinRetryInterval; ; {
+		if fn() == nil {
+			return true
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		if backoff *= 2; backoff > watchMaxRetryInterval {
+			backoff = watchMaxRetryInterval
+		}
+	}
+}
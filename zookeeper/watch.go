@@ -0,0 +1,126 @@
+package zookeeper
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// reader of the znodes, it's implemented by the connection and by the treeWatch
+type reader interface {
+	Get(znode string) ([]byte, *zk.Stat, error)
+	Children(znode string) ([]string, *zk.Stat, error)
+}
+
+// treeWatch reads the znodes and sets the ZooKeeper watches on them.
+// The watches are one-time triggers, so the watch of the znode is set again
+// only after it's fired, the armed watches aren't duplicated by the next reads.
+// The missing znodes are watched for the creation.
+//
+// It's used by the single goroutine of the watch.
+type treeWatch struct {
+	conn     *zk.Conn
+	data     map[string]<-chan zk.Event // Armed watches of the data and of the existence
+	children map[string]<-chan zk.Event // Armed watches of the children
+
+	// synced is true if the state is read after the last fired watch
+	synced bool
+}
+
+func newTreeWatch(conn *zk.Conn) *treeWatch {
+	return &treeWatch{
+		conn:     conn,
+		data:     map[string]<-chan zk.Event{},
+		children: map[string]<-chan zk.Event{},
+	}
+}
+
+func (w *treeWatch) Get(znode string) ([]byte, *zk.Stat, error) {
+	if _, ok := w.data[znode]; ok {
+		return w.conn.Get(znode)
+	}
+	for {
+		data, stat, events, err := w.conn.GetW(znode)
+		if err != zk.ErrNoNode {
+			if err == nil {
+				w.data[znode] = events
+			}
+			return data, stat, err
+		}
+		if exists, err := w.watchCreation(znode); exists || err != nil {
+			if err != nil {
+				return nil, nil, err
+			}
+			continue // The znode is created between the requests
+		}
+		return nil, nil, zk.ErrNoNode
+	}
+}
+
+func (w *treeWatch) Children(znode string) ([]string, *zk.Stat, error) {
+	if _, ok := w.children[znode]; ok {
+		return w.conn.Children(znode)
+	}
+	for {
+		children, stat, events, err := w.conn.ChildrenW(znode)
+		if err != zk.ErrNoNode {
+			if err == nil {
+				w.children[znode] = events
+			}
+			return children, stat, err
+		}
+		if exists, err := w.watchCreation(znode); exists || err != nil {
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return nil, nil, zk.ErrNoNode
+	}
+}
+
+// watchCreation of the missing znode, returns true if the znode exists already
+func (w *treeWatch) watchCreation(znode string) (bool, error) {
+	if _, ok := w.data[znode]; ok {
+		return false, nil
+	}
+	exists, _, events, err := w.conn.ExistsW(znode)
+	if err != nil || exists {
+		// The data watch of the existing znode is left, it's just fired once more
+		return exists, err
+	}
+	w.data[znode] = events
+	return false, nil
+}
+
+// wait blocks until any read znode is changed since the last read,
+// the first read of the state (the zero index) and the read after the failed one aren't blocked
+func (w *treeWatch) wait(ctx context.Context, index uint64) error {
+	if index == 0 || !w.synced {
+		return nil
+	}
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}}
+	for _, watches := range []map[string]<-chan zk.Event{w.data, w.children} {
+		for _, events := range watches {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(events)})
+		}
+	}
+	if chosen, _, _ := reflect.Select(cases); chosen == 0 {
+		return ctx.Err()
+	}
+	w.synced = false
+
+	// All fired watches are dropped to be set again by the next read,
+	// the channel of the fired watch is closed after the event
+	for _, watches := range []map[string]<-chan zk.Event{w.data, w.children} {
+		for znode, events := range watches {
+			select {
+			case <-events:
+				delete(watches, znode)
+			default:
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+// Package zookeeper implements the registry backend which keeps the KV storage
+// and the service catalogue in the ZooKeeper ensemble.
+//
+// The backend is selected by the zk:// DSN scheme:
+//
+//	import _ "github.com/trafficstars/registry/zookeeper"
+//
+//	r, _ := registry.New("zk://127.0.0.1:2181,127.0.0.2:2181/chroot?dc=dc1", os.Args)
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+
+	"github.com/trafficstars/registry"
+)
+
+const (
+	// servicesPrefix is the znode of the registered services
+	servicesPrefix = "services"
+
+	sessionTimeout = 10 * time.Second
+)
+
+var acl = zk.WorldACL(zk.PermAll)
+
+func init() {
+	registry.RegisterDriver("zk", newBackend)
+}
+
+// newBackend connects to the ZooKeeper ensemble defined as
+// zk://host1:2181,host2:2181/chroot?dc=dc1
+func newBackend(url *url.URL) (registry.KV, registry.Discovery, error) {
+	conn, events, err := zk.Connect(strings.Split(url.Host, ","), sessionTimeout, zk.WithLogInfo(false))
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		root = strings.TrimSuffix(url.Path, "/")
+		d    = &discovery{
+			conn:          conn,
+			root:          root,
+			datacenter:    url.Query().Get("dc"),
+			registrations: map[string]registration{},
+		}
+	)
+	go d.supervisor(events)
+	return &kv{conn: conn, root: root}, d, nil
+}
+
+// createNode creates the znode and all its missing parents
+func createNode(conn *zk.Conn, znode string, data []byte, flags int32) (string, error) {
+	p, err := conn.Create(znode, data, flags, acl)
+	if err == zk.ErrNoNode {
+		if parent := path.Dir(znode); parent != "/" {
+			if _, err = createNode(conn, parent, nil, 0); err != nil && err != zk.ErrNodeExists {
+				return "", err
+			}
+		}
+		p, err = conn.Create(znode, data, flags, acl)
+	}
+	return p, err
+}
+
+type kv struct {
+	conn *zk.Conn
+	root string
+}
+
+func (kv *kv) Get(key string) (string, error) {
+	v, _, err := kv.conn.Get(path.Join("/", kv.root, registry.RegistryPrefix, key))
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(v), nil
+}
+
+func (kv *kv) Set(key, value string) error {
+	znode := path.Join("/", kv.root, registry.RegistryPrefix, key)
+	_, err := kv.conn.Set(znode, []byte(value), -1)
+	if err == zk.ErrNoNode {
+		_, err = createNode(kv.conn, znode, []byte(value), 0)
+	}
+	return err
+}
+
+// List all keys which start with the prefix
+func (kv *kv) List(prefix string) (map[string]string, error) {
+	entries, err := kv.list(kv.conn, prefix)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]string, len(entries))
+	for key, entry := range entries {
+		list[key] = entry.Value
+	}
+	return list, nil
+}
+
+// list the keys which start with the prefix
+//
+// ZooKeeper has no prefix queries, so the tree is walked
+// from the deepest znode which contains all matched keys
+func (kv *kv) list(r reader, prefix string) (map[string]registry.KVEntry, error) {
+	var (
+		entries = map[string]registry.KVEntry{}
+		dir     = prefix
+	)
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	if err := kv.walk(r, strings.Trim(dir, "/."), prefix, entries); err != nil && err != zk.ErrNoNode {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// walk the children of the key, the znodes without the data are the directories,
+// but the key set to the empty value is listed
+func (kv *kv) walk(r reader, key, prefix string, entries map[string]registry.KVEntry) error {
+	children, _, err := r.Children(path.Join("/", kv.root, key))
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if len(key) != 0 {
+			child = key + "/" + child
+		}
+		if !strings.HasPrefix(child, prefix) && !strings.HasPrefix(prefix, child+"/") {
+			continue
+		}
+		if strings.HasPrefix(child, prefix) {
+			v, stat, err := r.Get(path.Join("/", kv.root, child))
+			if err != nil && err != zk.ErrNoNode {
+				return err
+			}
+			if v != nil {
+				entries[child] = registry.KVEntry{Value: string(v), ModifyIndex: uint64(stat.Mzxid)}
+			}
+		}
+		if err := kv.walk(r, child, prefix, entries); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kv *kv) Watch(ctx context.Context, key string) (<-chan registry.KVEvent, error) {
+	key = registry.RegistryPrefix + "/" + key
+	return registry.WatchKV(ctx, kv.watch(func(r reader) (map[string]registry.KVEntry, error) {
+		v, stat, err := r.Get(path.Join("/", kv.root, key))
+		if err != nil {
+			if err == zk.ErrNoNode {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return map[string]registry.KVEntry{key: {Value: string(v), ModifyIndex: uint64(stat.Mzxid)}}, nil
+	}))
+}
+
+func (kv *kv) WatchPrefix(ctx context.Context, prefix string) (<-chan registry.KVEvent, error) {
+	return registry.WatchKV(ctx, kv.watch(func(r reader) (map[string]registry.KVEntry, error) {
+		return kv.list(r, prefix)
+	}))
+}
+
+// watch lists the keys again every time when any read znode is changed
+func (kv *kv) watch(list func(r reader) (map[string]registry.KVEntry, error)) registry.KVFetchFunc {
+	w := newTreeWatch(kv.conn)
+	return func(ctx context.Context, index uint64) (map[string]registry.KVEntry, uint64, error) {
+		if err := w.wait(ctx, index); err != nil {
+			return nil, 0, err
+		}
+		entries, err := list(w)
+		if err != nil {
+			return nil, 0, err
+		}
+		w.synced = true
+		return entries, index + 1, nil
+	}
+}
+
+func (kv *kv) Delete(key string) error {
+	if err := kv.conn.Delete(path.Join("/", kv.root, registry.RegistryPrefix, key), -1); err != nil && err != zk.ErrNoNode {
+		return err
+	}
+	return nil
+}
+
+// registration keeps the service registered by this process
+type registration struct {
+	znode string
+	id    string
+	name  string
+	data  []byte
+}
+
+// discovery stores every service instance as JSON in the ephemeral
+// sequential znode services/<name>/<id>-<seq>. The znode disappears
+// together with the session, so every found service is considered as passing
+// unless it's in maintenance.
+type discovery struct {
+	mx            sync.Mutex
+	conn          *zk.Conn
+	root          string
+	datacenter    string
+	registrations map[string]registration
+}
+
+func (d *discovery) Register(options registry.ServiceOptions) error {
+	host, port, err := registry.SplitServiceAddress(options.Address)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(registry.Service{
+		ID:         options.ID,
+		Name:       options.Name,
+		Datacenter: d.datacenter,
+		Address:    host,
+		Port:       port,
+		Tags:       append(options.Tags, "DC="+d.datacenter),
+		Meta:       options.Meta,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The ephemeral znode of the previous registration has another sequence number
+	if err := d.Deregister(options.ID); err != nil {
+		return err
+	}
+
+	instance := registration{id: options.ID, name: options.Name, data: data}
+	if instance.znode, err = d.create(instance); err != nil {
+		return err
+	}
+
+	d.mx.Lock()
+	d.registrations[options.ID] = instance
+	d.mx.Unlock()
+	return nil
+}
+
+func (d *discovery) create(instance registration) (string, error) {
+	znode := path.Join("/", d.root, servicesPrefix, instance.name, instance.id) + "-"
+	return createNode(d.conn, znode, instance.data, zk.FlagEphemeral|zk.FlagSequence)
+}
+
+// Datacenter defined by the dc parameter of the DSN
+func (d *discovery) Datacenter() string {
+	return d.datacenter
+}
+
+func (d *discovery) Deregister(ident string) error {
+	d.mx.Lock()
+	registration, ok := d.registrations[ident]
+	delete(d.registrations, ident)
+	d.mx.Unlock()
+	if ok {
+		if err := d.conn.Delete(registration.znode, -1); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+		return nil
+	}
+
+	// The service could be registered by another process
+	znodes, err := d.znodes(ident)
+	if err != nil {
+		return err
+	}
+	for _, znode := range znodes {
+		if err := d.conn.Delete(znode, -1); err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	return nil
+}
+
+// znodes returns the paths of the instance znodes
+func (d *discovery) znodes(ident string) ([]string, error) {
+	names, _, err := d.conn.Children(path.Join("/", d.root, servicesPrefix))
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var znodes []string
+	for _, name := range names {
+		dir := path.Join("/", d.root, servicesPrefix, name)
+		instances, _, err := d.conn.Children(dir)
+		if err != nil && err != zk.ErrNoNode {
+			return nil, err
+		}
+		for _, instance := range instances {
+			if instanceID(instance) == ident {
+				znodes = append(znodes, dir+"/"+instance)
+			}
+		}
+	}
+	return znodes, nil
+}
+
+// EnableMaintenance of the service, the flag is stored together with the instance
+func (d *discovery) EnableMaintenance(serviceID, reason string) error {
+	return d.setMaintenance(serviceID, true)
+}
+
+// DisableMaintenance of the service
+func (d *discovery) DisableMaintenance(serviceID string) error {
+	return d.setMaintenance(serviceID, false)
+}
+
+func (d *discovery) setMaintenance(ident string, maintenance bool) error {
+	znodes, err := d.znodes(ident)
+	if err != nil {
+		return err
+	}
+	if len(znodes) == 0 {
+		return fmt.Errorf("unknown service %q", ident)
+	}
+	for _, znode := range znodes {
+		data, stat, err := d.conn.Get(znode)
+		if err != nil {
+			if err == zk.ErrNoNode {
+				continue
+			}
+			return err
+		}
+		if data, err = maintenanceData(data, maintenance); err != nil {
+			return err
+		}
+		if _, err := d.conn.Set(znode, data, stat.Version); err != nil {
+			return err
+		}
+	}
+
+	// The znode restored after the session expiration keeps the flag
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if registration, ok := d.registrations[ident]; ok {
+		if registration.data, err = maintenanceData(registration.data, maintenance); err != nil {
+			return err
+		}
+		d.registrations[ident] = registration
+	}
+	return nil
+}
+
+func maintenanceData(data []byte, maintenance bool) ([]byte, error) {
+	var srv registry.Service
+	if err := json.Unmarshal(data, &srv); err != nil {
+		return nil, err
+	}
+	srv.Maintenance = maintenance
+	return json.Marshal(srv)
+}
+
+// Lookup services by filter
+func (d *discovery) Lookup(filter *registry.Filter) ([]registry.Service, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	return d.lookup(d.conn, filter)
+}
+
+func (d *discovery) lookup(r reader, filter *registry.Filter) ([]registry.Service, error) {
+	filter = filter.WithoutAllDatacenter()
+
+	names := []string{filter.Service}
+	if len(filter.Service) == 0 {
+		var err error
+		if names, _, err = r.Children(path.Join("/", d.root, servicesPrefix)); err != nil {
+			if err == zk.ErrNoNode {
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	var services []registry.Service
+	for _, name := range names {
+		dir := path.Join("/", d.root, servicesPrefix, name)
+		instances, _, err := r.Children(dir)
+		if err != nil {
+			if err == zk.ErrNoNode {
+				continue
+			}
+			return nil, err
+		}
+		for _, instance := range instances {
+			data, _, err := r.Get(dir + "/" + instance)
+			if err != nil {
+				if err == zk.ErrNoNode {
+					continue
+				}
+				return nil, err
+			}
+			var srv registry.Service
+			if err := json.Unmarshal(data, &srv); err != nil {
+				continue
+			}
+			if srv.Status = registry.SERVICE_STATUS_PASSING; srv.Maintenance {
+				srv.Status = registry.SERVICE_STATUS_CRITICAL
+			}
+			if srv.Match(filter) {
+				services = append(services, srv)
+			}
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services, nil
+}
+
+// Watch the services by the ZooKeeper watches of the service znodes
+func (d *discovery) Watch(ctx context.Context, filter *registry.Filter) (<-chan []registry.Service, error) {
+	w := newTreeWatch(d.conn)
+	return registry.WatchServices(ctx, filter, func(ctx context.Context, index uint64) ([]registry.Service, uint64, error) {
+		if err := w.wait(ctx, index); err != nil {
+			return nil, 0, err
+		}
+		services, err := d.lookup(w, filter)
+		if err != nil {
+			return nil, 0, err
+		}
+		w.synced = true
+		return services, index + 1, nil
+	})
+}
+
+// supervisor restores the ephemeral znodes of the registered services
+// after the session expiration
+func (d *discovery) supervisor(events <-chan zk.Event) {
+	var expired bool
+	for event := range events {
+		if event.Type != zk.EventSession {
+			continue
+		}
+		switch event.State {
+		case zk.StateExpired:
+			expired = true
+		case zk.StateHasSession:
+			if !expired {
+				continue
+			}
+			expired = false
+			d.mx.Lock()
+			for ident, registration := range d.registrations {
+				if znode, err := d.create(registration); err == nil {
+					registration.znode = znode
+					d.registrations[ident] = registration
+				}
+			}
+			d.mx.Unlock()
+		}
+	}
+}
+
+// instanceID cuts the sequence suffix from the znode name
+func instanceID(znode string) string {
+	if i := strings.LastIndex(znode, "-"); i != -1 {
+		return znode[:i]
+	}
+	return znode
+}
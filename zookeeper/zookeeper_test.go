@@ -0,0 +1,581 @@
+package zookeeper
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/trafficstars/registry"
+)
+
+// ZooKeeper wire protocol constants used by the fake server
+const (
+	opCreate       = 1
+	opDelete       = 2
+	opExists       = 3
+	opGetData      = 4
+	opSetData      = 5
+	opPing         = 11
+	opGetChildren2 = 12
+	opClose        = -11
+
+	errUnimplemented = -6
+	errNoNode        = -101
+	errNodeExists    = -110
+	errNotEmpty      = -111
+
+	flagEphemeral = 1
+	flagSequence  = 2
+
+	eventNodeCreated         = 1
+	eventNodeDeleted         = 2
+	eventNodeDataChanged     = 3
+	eventNodeChildrenChanged = 4
+	stateSyncConnected       = 3
+)
+
+type fakeNode struct {
+	data     []byte
+	owner    int64
+	sequence int32
+}
+
+// fakeSession is the connection of the client
+type fakeSession struct {
+	id   int64
+	mx   sync.Mutex
+	conn net.Conn
+}
+
+func (s *fakeSession) write(frame []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+// notify the client about the fired watch
+func (s *fakeSession) notify(eventType int32, znode string) {
+	var event encoder
+	event.int32(-1) // xid of the watch event
+	event.int64(-1)
+	event.int32(0)
+	event.int32(eventType)
+	event.int32(stateSyncConnected)
+	event.string(znode)
+	s.write(event.frame())
+}
+
+// fakeServer implements the subset of the ZooKeeper wire protocol
+// which is used by the zk backend: sessions, ping, the basic
+// znode operations and the watches without ACL checks
+type fakeServer struct {
+	mx           sync.Mutex
+	listener     net.Listener
+	nodes        map[string]*fakeNode
+	zxid         int64
+	sessionID    int64
+	dataWatches  map[string]map[*fakeSession]bool // Watches of the data and of the existence
+	childWatches map[string]map[*fakeSession]bool
+	reads        int // Count of the read requests
+}
+
+func runZookeeperFake(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{
+		listener:     listener,
+		nodes:        map[string]*fakeNode{"/": {}},
+		dataWatches:  map[string]map[*fakeSession]bool{},
+		childWatches: map[string]map[*fakeSession]bool{},
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	frame, err := readFrame(conn)
+	if err != nil {
+		return
+	}
+	var (
+		req     = decoder{buf: frame}
+		_       = req.int32() // protocol version
+		_       = req.int64() // last zxid seen
+		timeout = req.int32()
+		resp    encoder
+		session = &fakeSession{conn: conn}
+	)
+	s.mx.Lock()
+	s.sessionID++
+	session.id = s.sessionID
+	s.mx.Unlock()
+	defer s.expire(session)
+
+	resp.int32(0)
+	resp.int32(timeout)
+	resp.int64(session.id)
+	resp.buffer(make([]byte, 16))
+	if err := session.write(resp.frame()); err != nil {
+		return
+	}
+
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		var (
+			req    = decoder{buf: frame}
+			xid    = req.int32()
+			opcode = req.int32()
+			body   encoder
+		)
+		code := s.handle(session, opcode, &req, &body)
+
+		s.mx.Lock()
+		s.zxid++
+		zxid := s.zxid
+		s.mx.Unlock()
+
+		var resp encoder
+		resp.int32(xid)
+		resp.int64(zxid)
+		resp.int32(code)
+		if code == 0 {
+			resp.buf.Write(body.buf.Bytes())
+		}
+		if err := session.write(resp.frame()); err != nil || opcode == opClose {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) handle(session *fakeSession, opcode int32, req *decoder, resp *encoder) int32 {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	switch opcode {
+	case opPing, opClose:
+	case opCreate:
+		var (
+			znode = req.string()
+			data  = req.buffer()
+		)
+		for i := req.int32(); i > 0; i-- { // ACL
+			req.int32()
+			req.string()
+			req.string()
+		}
+		flags := req.int32()
+		parent, ok := s.nodes[path.Dir(znode)]
+		if !ok {
+			return errNoNode
+		}
+		if flags&flagSequence != 0 {
+			znode += fmt.Sprintf("%010d", parent.sequence)
+			parent.sequence++
+		}
+		if _, ok := s.nodes[znode]; ok {
+			return errNodeExists
+		}
+		node := &fakeNode{data: data}
+		if flags&flagEphemeral != 0 {
+			node.owner = session.id
+		}
+		s.nodes[znode] = node
+		s.fire(s.dataWatches, znode, eventNodeCreated)
+		s.fire(s.childWatches, path.Dir(znode), eventNodeChildrenChanged)
+		resp.string(znode)
+	case opDelete:
+		znode := req.string()
+		if _, ok := s.nodes[znode]; !ok {
+			return errNoNode
+		}
+		if len(s.children(znode)) != 0 {
+			return errNotEmpty
+		}
+		s.delete(znode)
+	case opExists:
+		znode := req.string()
+		s.watch(s.dataWatches, znode, session, req.bool())
+		if _, ok := s.nodes[znode]; !ok {
+			return errNoNode
+		}
+		resp.stat()
+	case opGetData:
+		znode, watch := req.string(), req.bool()
+		node, ok := s.nodes[znode]
+		if !ok {
+			return errNoNode
+		}
+		s.reads++
+		s.watch(s.dataWatches, znode, session, watch)
+		resp.buffer(node.data)
+		resp.stat()
+	case opSetData:
+		znode := req.string()
+		node, ok := s.nodes[znode]
+		if !ok {
+			return errNoNode
+		}
+		node.data = req.buffer()
+		s.fire(s.dataWatches, znode, eventNodeDataChanged)
+		resp.stat()
+	case opGetChildren2:
+		znode, watch := req.string(), req.bool()
+		if _, ok := s.nodes[znode]; !ok {
+			return errNoNode
+		}
+		s.reads++
+		s.watch(s.childWatches, znode, session, watch)
+		children := s.children(znode)
+		resp.int32(int32(len(children)))
+		for _, child := range children {
+			resp.string(child)
+		}
+		resp.stat()
+	default:
+		return errUnimplemented
+	}
+	return 0
+}
+
+func (s *fakeServer) children(znode string) (children []string) {
+	for p := range s.nodes {
+		if p != "/" && path.Dir(p) == znode {
+			children = append(children, path.Base(p))
+		}
+	}
+	return children
+}
+
+// delete the znode and fire its watches, mx must be locked
+func (s *fakeServer) delete(znode string) {
+	delete(s.nodes, znode)
+	s.fire(s.dataWatches, znode, eventNodeDeleted)
+	s.fire(s.childWatches, znode, eventNodeDeleted)
+	s.fire(s.childWatches, path.Dir(znode), eventNodeChildrenChanged)
+}
+
+// watch the znode by the session if it's requested, mx must be locked
+func (s *fakeServer) watch(watches map[string]map[*fakeSession]bool, znode string, session *fakeSession, watch bool) {
+	if !watch {
+		return
+	}
+	if watches[znode] == nil {
+		watches[znode] = map[*fakeSession]bool{}
+	}
+	watches[znode][session] = true
+}
+
+// fire the one-time watches of the znode, mx must be locked
+func (s *fakeServer) fire(watches map[string]map[*fakeSession]bool, znode string, eventType int32) {
+	for session := range watches[znode] {
+		session.notify(eventType, znode)
+	}
+	delete(watches, znode)
+}
+
+// expire removes all ephemeral nodes and the watches of the session
+func (s *fakeServer) expire(session *fakeSession) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, watches := range []map[string]map[*fakeSession]bool{s.dataWatches, s.childWatches} {
+		for _, sessions := range watches {
+			delete(sessions, session)
+		}
+	}
+	for p, node := range s.nodes {
+		if node.owner == session.id {
+			s.delete(p)
+		}
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err := io.ReadFull(r, frame)
+	return frame, err
+}
+
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *decoder) int32() int32 {
+	v := int32(binary.BigEndian.Uint32(d.buf[d.pos:]))
+	d.pos += 4
+	return v
+}
+
+func (d *decoder) int64() int64 {
+	v := int64(binary.BigEndian.Uint64(d.buf[d.pos:]))
+	d.pos += 8
+	return v
+}
+
+func (d *decoder) bool() bool {
+	v := d.buf[d.pos] != 0
+	d.pos++
+	return v
+}
+
+func (d *decoder) buffer() []byte {
+	size := d.int32()
+	if size < 0 {
+		return nil
+	}
+	v := append([]byte{}, d.buf[d.pos:d.pos+int(size)]...)
+	d.pos += int(size)
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.buffer())
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) int32(v int32) {
+	binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *encoder) int64(v int64) {
+	binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+// buffer writes the nil data as -1 like ZooKeeper does for the znodes without the data
+func (e *encoder) buffer(v []byte) {
+	if v == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) string(v string) {
+	e.buffer([]byte(v))
+}
+
+// stat writes the empty znode stat structure
+func (e *encoder) stat() {
+	e.buf.Write(make([]byte, 68))
+}
+
+func (e *encoder) frame() []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(e.buf.Len()))
+	return append(size[:], e.buf.Bytes()...)
+}
+
+func nextEvent(t *testing.T, events <-chan registry.KVEvent) registry.KVEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return registry.KVEvent{}
+}
+
+func Test_Zookeeper(t *testing.T) {
+	server := runZookeeperFake(t)
+	r, err := registry.New("zk://"+server.Addr()+"/chroot?dc=dc1", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Run("kv", func(t *testing.T) {
+		kv := r.KV()
+		assert.NoError(t, kv.Set("service/name", "test"))
+		assert.NoError(t, kv.Set("service/id", "42"))
+		assert.NoError(t, kv.Set("services", "-"))
+		if v, err := kv.Get("service/name"); assert.NoError(t, err) {
+			assert.Equal(t, "test", v)
+		}
+		if list, err := kv.List(registry.RegistryPrefix + "/service/"); assert.NoError(t, err) {
+			assert.Equal(t, map[string]string{
+				registry.RegistryPrefix + "/service/name": "test",
+				registry.RegistryPrefix + "/service/id":   "42",
+			}, list)
+		}
+		if list, err := kv.List(registry.RegistryPrefix + "/serv"); assert.NoError(t, err) {
+			assert.Len(t, list, 3)
+		}
+		if assert.NoError(t, kv.Delete("service/name")) {
+			if v, err := kv.Get("service/name"); assert.NoError(t, err) {
+				assert.Equal(t, "", v)
+			}
+		}
+		server.mx.Lock()
+		_, ok := server.nodes["/chroot/"+registry.RegistryPrefix+"/service/id"]
+		server.mx.Unlock()
+		assert.True(t, ok, "the key has to be stored under chroot")
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		kv := r.KV()
+		events, err := kv.WatchPrefix(ctx, registry.RegistryPrefix+"/watch/")
+		if !assert.NoError(t, err) {
+			return
+		}
+		kv.Set("watch/key", "1")
+		event := nextEvent(t, events)
+		assert.Equal(t, registry.KV_EVENT_PUT, event.Type)
+		assert.Equal(t, registry.RegistryPrefix+"/watch/key", event.Key)
+		assert.Equal(t, "1", event.Value)
+
+		kv.Delete("watch/key")
+		event = nextEvent(t, events)
+		assert.Equal(t, registry.KV_EVENT_DELETE, event.Type)
+		assert.Equal(t, registry.RegistryPrefix+"/watch/key", event.Key)
+
+		kv.Set("watch/empty", "")
+		event = nextEvent(t, events)
+		assert.Equal(t, registry.KV_EVENT_PUT, event.Type)
+		assert.Equal(t, registry.RegistryPrefix+"/watch/empty", event.Key, "the empty value is the key too")
+
+		// The watches fired by the one change can be read again once more
+		time.Sleep(100 * time.Millisecond)
+		server.mx.Lock()
+		reads := server.reads
+		server.mx.Unlock()
+		time.Sleep(200 * time.Millisecond)
+		server.mx.Lock()
+		assert.Equal(t, reads, server.reads, "the unchanged keys aren't read again")
+		server.mx.Unlock()
+	})
+
+	t.Run("watch services", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		discovery := r.Discovery()
+		updates, err := discovery.Watch(ctx, &registry.Filter{Service: "queue"})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, <-updates, 0)
+
+		assert.NoError(t, discovery.Register(registry.ServiceOptions{ID: "queue-1", Name: "queue", Address: "127.0.0.1:5672"}))
+		select {
+		case services := <-updates:
+			if assert.Len(t, services, 1) {
+				assert.Equal(t, "queue-1", services[0].ID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update")
+		}
+
+		assert.NoError(t, discovery.Deregister("queue-1"))
+		select {
+		case services := <-updates:
+			assert.Len(t, services, 0)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no update")
+		}
+	})
+
+	t.Run("discovery", func(t *testing.T) {
+		discovery := r.Discovery()
+		for _, id := range []string{"api-1", "api-2"} {
+			err := discovery.Register(registry.ServiceOptions{
+				ID:      id,
+				Name:    "api",
+				Address: "http://127.0.0.1:8080",
+				Tags:    []string{"test"},
+			})
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, discovery.Register(registry.ServiceOptions{ID: "db-1", Name: "db", Address: "127.0.0.2:5432"}))
+
+		services, err := discovery.Lookup(&registry.Filter{Service: "api", Tags: []string{"test"}})
+		if assert.NoError(t, err) && assert.Len(t, services, 2) {
+			assert.Equal(t, registry.Service{
+				ID:         "api-1",
+				Name:       "api",
+				Datacenter: "dc1",
+				Address:    "127.0.0.1",
+				Port:       8080,
+				Tags:       []string{"test", "DC=dc1"},
+				Status:     registry.SERVICE_STATUS_PASSING,
+			}, services[0])
+		}
+
+		services, err = discovery.Lookup(&registry.Filter{Datacenter: "all"})
+		if assert.NoError(t, err) {
+			assert.Len(t, services, 3)
+		}
+
+		if assert.NoError(t, discovery.Deregister("api-1")) {
+			services, err = discovery.Lookup(&registry.Filter{Service: "api"})
+			if assert.NoError(t, err) && assert.Len(t, services, 1) {
+				assert.Equal(t, "api-2", services[0].ID)
+			}
+		}
+
+		server.mx.Lock()
+		for p, node := range server.nodes {
+			if strings.HasPrefix(p, "/chroot/services/api/api-2-") {
+				assert.NotZero(t, node.owner, "the service has to be registered as ephemeral node")
+			}
+		}
+		server.mx.Unlock()
+	})
+
+	t.Run("maintenance", func(t *testing.T) {
+		discovery := r.Discovery()
+		assert.NoError(t, discovery.Register(registry.ServiceOptions{ID: "web-1", Name: "web", Address: "127.0.0.1:80"}))
+		assert.Error(t, discovery.EnableMaintenance("unknown", "test"))
+		if assert.NoError(t, discovery.EnableMaintenance("web-1", "test")) {
+			services, err := discovery.Lookup(&registry.Filter{Service: "web"})
+			if assert.NoError(t, err) && assert.Len(t, services, 1) {
+				assert.True(t, services[0].Maintenance)
+				assert.Equal(t, registry.SERVICE_STATUS_CRITICAL, services[0].Status)
+			}
+		}
+		if assert.NoError(t, discovery.DisableMaintenance("web-1")) {
+			services, err := discovery.Lookup(&registry.Filter{Service: "web", Status: registry.SERVICE_STATUS_PASSING})
+			if assert.NoError(t, err) {
+				assert.Len(t, services, 1)
+			}
+		}
+	})
+}